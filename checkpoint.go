@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var CHECKPOINT_INTERVAL = 5 * time.Second
+
+// Checkpoints remember the timestamp of the last line forwarded for each container stream
+// so following logs can resume where it left off after a reconnect or an agent restart
+//
+// A checkpoint advances once a line is handed to the sinks, not when it is delivered. On shutdown
+// checkpoints are frozen, the sinks are flushed and only then saved, so every checkpointed line was
+// delivered and lines are sent at least once across agent upgrades and respawns. Kinesis lines are
+// spooled to disk first, but lines awslogs has batched for CloudWatch are lost if the agent crashes.
+type Checkpoints struct {
+	path string
+
+	lock   sync.Mutex
+	times  map[string]time.Time
+	dirty  bool
+	frozen bool
+}
+
+func NewCheckpoints(path string) *Checkpoints {
+	return &Checkpoints{
+		path:  path,
+		times: map[string]time.Time{},
+	}
+}
+
+// Load reads checkpoints saved by a previous agent
+func (c *Checkpoints) Load() error {
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return json.Unmarshal(data, &c.times)
+}
+
+// Save writes checkpoints if any changed since the last save
+func (c *Checkpoints) Save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c.times)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	// write and rename so a crash never leaves a partial file
+	tmp := c.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+func (c *Checkpoints) Get(id, stream string) (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ts, ok := c.times[id+"/"+stream]
+	return ts, ok
+}
+
+// Set advances the checkpoint for a container stream
+func (c *Checkpoints) Set(id, stream string, ts time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.frozen {
+		return
+	}
+
+	if ts.After(c.times[id+"/"+stream]) {
+		c.times[id+"/"+stream] = ts
+		c.dirty = true
+	}
+}
+
+// Delete forgets a container once its logs have been followed to the end
+func (c *Checkpoints) Delete(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, stream := range []string{"stdout", "stderr"} {
+		if _, ok := c.times[id+"/"+stream]; ok {
+			delete(c.times, id+"/"+stream)
+			c.dirty = true
+		}
+	}
+}
+
+// Freeze stops checkpoints from advancing so lines forwarded while the sinks flush are sent again after a restart
+func (c *Checkpoints) Freeze() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frozen = true
+}
+
+// Containers returns the ids of containers with a checkpoint
+func (c *Checkpoints) Containers() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	seen := map[string]bool{}
+	ids := []string{}
+
+	for key := range c.times {
+		id := strings.SplitN(key, "/", 2)[0]
+
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func (m *Monitor) saveCheckpoints() {
+	for _ = range time.Tick(CHECKPOINT_INTERVAL) {
+		if err := m.checkpoints.Save(); err != nil {
+			m.logSystemf("container saveCheckpoints path=%s count#CheckpointError=1 err=%q", m.checkpoints.path, err)
+		}
+	}
+}
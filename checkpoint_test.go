@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoints.json")
+	ts := time.Date(2016, 4, 20, 17, 59, 27, 123456789, time.UTC)
+
+	c := NewCheckpoints(path)
+	assert.Nil(t, c.Load())
+
+	c.Set("1d11a78279e0", "stdout", ts)
+	c.Set("1d11a78279e0", "stdout", ts.Add(-1*time.Second)) // never moves back
+	c.Set("1d11a78279e0", "stderr", ts)
+	c.Set("2f3c6e1a9b00", "stdout", ts)
+	c.Delete("2f3c6e1a9b00")
+	assert.Nil(t, c.Save())
+
+	c = NewCheckpoints(path)
+	assert.Nil(t, c.Load())
+
+	out, ok := c.Get("1d11a78279e0", "stdout")
+	assert.True(t, ok)
+	assert.True(t, ts.Equal(out))
+
+	_, ok = c.Get("2f3c6e1a9b00", "stdout")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"1d11a78279e0"}, c.Containers())
+
+	// lines forwarded after a freeze are sent again after a restart
+	c.Freeze()
+	c.Set("1d11a78279e0", "stdout", ts.Add(1*time.Second))
+
+	out, _ = c.Get("1d11a78279e0", "stdout")
+	assert.True(t, ts.Equal(out))
+}
@@ -6,12 +6,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/docker/docker/daemon/logger"
 	"github.com/docker/docker/daemon/logger/awslogs"
 	docker "github.com/fsouza/go-dockerclient"
@@ -20,6 +20,11 @@ import (
 func (m *Monitor) Containers() {
 	m.logSystemf("container at=start")
 
+	if err := m.checkpoints.Load(); err != nil {
+		m.logSystemf("container checkpoints.Load path=%s count#CheckpointError=1 err=%q", m.checkpoints.path, err)
+	}
+
+	m.pruneCheckpoints()
 	m.handleRunning()
 	m.handleExited()
 
@@ -27,17 +32,40 @@ func (m *Monitor) Containers() {
 
 	go m.handleEvents(ch)
 	go m.streamLogs()
+	go m.saveCheckpoints()
+	go m.reportSuppressed()
 
 	// HACK: Range over instrumentation messages channel added to awslogs package
 	go func() {
 		for msg := range awslogs.ConvoxSystemMessages {
 			m.logSystemf(msg)
+
+			if group, n, ok := awslogsErrors(msg); ok {
+				m.metrics.Count("CloudWatchLogsError", m.dimensions("group", group), float64(n))
+			}
 		}
 	}()
 
 	m.client.AddEventListener(ch)
 }
 
+var awslogsErrorsMessage = regexp.MustCompile(`dim#group=(\S+) count#CloudWatchEventsErrors=(\d+)`)
+
+// awslogsErrors returns the log group and number of events from an awslogs message about a failed publish
+func awslogsErrors(msg string) (string, int, bool) {
+	match := awslogsErrorsMessage.FindStringSubmatch(msg)
+	if match == nil {
+		return "", 0, false
+	}
+
+	n, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return match[1], n, true
+}
+
 // List already running containers and subscribe and stream logs
 func (m *Monitor) handleRunning() {
 	m.logSystemf("container handleRunning at=start")
@@ -89,12 +117,61 @@ func (m *Monitor) handleExited() {
 
 	for _, container := range containers {
 		m.logSystemf("container handleExited id=%s", container.ID)
+
+		// a container with a checkpoint exited while the agent was stopped, ship the rest of its logs
+		_, stdout := m.checkpoints.Get(container.ID, "stdout")
+		_, stderr := m.checkpoints.Get(container.ID, "stderr")
+
+		if stdout || stderr {
+			m.handleCreate(container.ID)
+			go m.subscribeLogs(container.ID)
+		}
+
 		m.handleDie(container.ID)
 	}
 
 	m.logSystemf("container handleExited at=end")
 }
 
+// pruneCheckpoints forgets containers that were removed while the agent was stopped
+func (m *Monitor) pruneCheckpoints() {
+	containers, err := m.client.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		m.logSystemf("container pruneCheckpoints count#DockerListContainersError=1 err=%q", err)
+		m.metrics.Count("DockerListContainersError", m.dimensions(), 1)
+		return
+	}
+
+	exists := map[string]bool{}
+
+	for _, container := range containers {
+		exists[container.ID] = true
+	}
+
+	for _, id := range m.checkpoints.Containers() {
+		if !exists[id] {
+			m.logSystemf("container pruneCheckpoints id=%s", id)
+			m.checkpoints.Delete(id)
+		}
+	}
+}
+
+// Shutdown delivers what the sinks have buffered then saves checkpoints
+// so the next agent resumes following logs after the last delivered line
+func (m *Monitor) Shutdown() {
+	m.logSystemf("container Shutdown at=start")
+
+	m.checkpoints.Freeze()
+
+	m.flushSinks()
+
+	if err := m.checkpoints.Save(); err != nil {
+		m.logSystemf("container Shutdown path=%s count#CheckpointError=1 err=%q", m.checkpoints.path, err)
+	}
+
+	m.logSystemf("container Shutdown at=end")
+}
+
 func (m *Monitor) handleEvents(ch chan *docker.APIEvents) {
 	m.logSystemf("container handleEvents at=start")
 
@@ -121,6 +198,8 @@ func (m *Monitor) handleEvents(ch chan *docker.APIEvents) {
 		}
 
 		metric := "DockerEvent" + ucfirst(event.Status)
+		m.metrics.Count("DockerEvent", m.dimensions("status", event.Status), 1)
+
 		msg := fmt.Sprintf("container handleEvents id=%s time=%d count#%s=1", event.ID, event.Time, metric)
 
 		if env, ok := m.getEnv(event.ID); ok {
@@ -156,6 +235,27 @@ func (m *Monitor) handleCreate(id string) {
 
 	m.setEnv(id, env)
 
+	redactor, rerr := NewRedactor(env, container.Config.Labels)
+	if rerr != nil {
+		m.logSystemf("container handleCreate id=%s NewRedactor count#RedactConfigError=1 err=%q", id, rerr)
+	}
+
+	m.setRedactor(id, redactor)
+
+	limiter, lerr := NewRateLimiter(env)
+	if lerr != nil {
+		m.logSystemf("container handleCreate id=%s NewRateLimiter count#RateLimitConfigError=1 err=%q", id, lerr)
+	}
+
+	m.setLimiter(id, limiter)
+
+	metrics, merr := NewLogMetrics(container.Config.Labels)
+	if merr != nil {
+		m.logSystemf("container handleCreate id=%s NewLogMetrics count#LogMetricConfigError=1 err=%q", id, merr)
+	}
+
+	m.setLogMetrics(id, metrics)
+
 	// create a an awslogger and associated CloudWatch Logs LogGroup
 	if env["LOG_GROUP"] != "" {
 		awslogger, aerr := m.StartAWSLogger(container, env["LOG_GROUP"])
@@ -182,15 +282,28 @@ func (m *Monitor) handleDie(id string) {
 	// It seems like explicitly doing a `docker run --rm` is the best way
 	// to state this intent.
 
-	msg := fmt.Sprintf("Dead process %s", id[0:12])
+	process := "process"
 
 	if env, ok := m.getEnv(id); ok {
 		if p := env["PROCESS"]; p != "" {
-			msg = fmt.Sprintf("Dead %s process %s", p, id[0:12])
+			process = p + " process"
 		}
 	}
 
-	m.logAppEvent(id, msg)
+	container, err := m.client.InspectContainer(id)
+	if err != nil {
+		m.logSystemf("container handleDie id=%s count#DockerInspectError=1 err=%q", id, err)
+		m.metrics.Count("DockerInspectError", m.dimensions(), 1)
+		m.logAppEvent(id, fmt.Sprintf("Dead %s %s", process, id[0:12]))
+		return
+	}
+
+	e := newExitInfo(container.State)
+
+	m.logSystemf("container handleDie id=%s exitCode=%d signal=%s oomKilled=%t started=%s finished=%s duration=%s", id, e.ExitCode, e.Signal, e.OOMKilled, e.Started.Format(time.RFC3339), e.Finished.Format(time.RFC3339), e.Duration)
+	m.logAppEventFields(id, e.Message(process, id[0:12]), e.Fields())
+
+	m.checkCrashLoop(id, e.ExitCode, e.OOMKilled, e.Finished)
 }
 
 func (m *Monitor) handleKill(id string) {
@@ -210,6 +323,11 @@ func (m *Monitor) handleKill(id string) {
 func (m *Monitor) handleOom(id string) {
 	m.logSystemf("container handleOom at=start id=%s", id)
 
+	// the kernel OOM report was already attributed to this container
+	if !m.markOOM(id) {
+		return
+	}
+
 	msg := fmt.Sprintf("Stopped process %s due to OOM", id[0:12])
 
 	if env, ok := m.getEnv(id); ok {
@@ -290,13 +408,19 @@ func (m *Monitor) subscribeLogs(id string) {
 retry:
 	for {
 		wg := new(sync.WaitGroup)
-		wg.Add(2)
+		wg.Add(3)
 
 		exit := make(chan bool)
-		r, w := io.Pipe()
+		rout, wout := io.Pipe()
+		rerr, werr := io.Pipe()
 
-		go m.readLines(id, r, wg, exit)
-		go m.followDockerLogs(id, w, wg, exit)
+		// resume each stream after the last line forwarded before a retry or agent restart
+		resumeOut, _ := m.checkpoints.Get(id, "stdout")
+		resumeErr, _ := m.checkpoints.Get(id, "stderr")
+
+		go m.readLines(id, "stdout", resumeOut, rout, wg, exit)
+		go m.readLines(id, "stderr", resumeErr, rerr, wg, exit)
+		go m.followDockerLogs(id, m.logsSince(id, resumeOut, resumeErr), wout, werr, wg, exit)
 
 		wg.Wait()
 
@@ -312,6 +436,7 @@ retry:
 			} else {
 				// container is still running, record metric and retry getting logs
 				m.logSystemf("container subscribeLogs id=%s count#DockerLogsRetry=1", id)
+				m.metrics.Count("DockerLogsRetry", m.dimensions(), 1)
 				continue
 			}
 
@@ -323,55 +448,90 @@ retry:
 		// Container state is indeterminate. Report exception and retry
 		default:
 			m.logSystemf("container subscribeLogs id=%s err=%q count#DockerInspectError=1 count#DockerLogsRetry=1", id, err)
+			m.metrics.Count("DockerInspectError", m.dimensions(), 1)
+			m.metrics.Count("DockerLogsRetry", m.dimensions(), 1)
 			m.ReportError(err)
 			continue
 		}
 	}
 
-	if awslogger, ok := m.getLogger(id); ok {
-		err := awslogger.Close()
-		if err != nil {
-			m.logSystemf("container subscribeLogs id=%s awslogger.Close err=%q", id, err)
-			m.ReportError(err)
-		} else {
-			m.logSystemf("container subscribeLogs id=%s awslogger.Close", id)
+	m.closeSinks(id)
+
+	m.checkpoints.Delete(id)
+
+	m.logSystemf("container subscribeLogs id=%s at=end", id)
+}
+
+// logsSince returns where to start following logs:
+// the earliest stream checkpoint, otherwise when the container started if that was after the agent started, otherwise now
+func (m *Monitor) logsSince(id string, resume ...time.Time) time.Time {
+	since := time.Time{}
+
+	for _, ts := range resume {
+		if !ts.IsZero() && (since.IsZero() || ts.Before(since)) {
+			since = ts
 		}
 	}
 
-	m.logSystemf("container subscribeLogs id=%s at=end", id)
+	if !since.IsZero() {
+		return since
+	}
+
+	c, err := m.client.InspectContainer(id)
+	if err == nil && c.State.StartedAt.After(m.started) {
+		return c.State.StartedAt
+	}
+
+	return time.Now()
 }
 
-func (m *Monitor) readLines(id string, r *io.PipeReader, wg *sync.WaitGroup, exit chan bool) {
-	m.logSystemf("container subscribeLogs readLines id=%s at=start", id)
+// readLines forwards lines from a container stream
+// Lines at or before the resume checkpoint were already forwarded and are skipped
+func (m *Monitor) readLines(id, stream string, resume time.Time, r *io.PipeReader, wg *sync.WaitGroup, exit chan bool) {
+	m.logSystemf("container subscribeLogs readLines id=%s stream=%s at=start", id, stream)
 
 	defer wg.Done()
 
+	env, _ := m.getEnv(id)
+
+	ml, err := NewMultiline(env, func(ts, last time.Time, line string) {
+		m.forwardLine(id, stream, ts, last, line)
+	})
+	if err != nil {
+		m.logSystemf("container subscribeLogs readLines id=%s NewMultiline err=%q", id, err)
+	}
+
+	if ml != nil {
+		defer ml.Flush()
+	}
+
 	br := bufio.NewReader(r)
 
 	for {
 		select {
 		case <-exit:
-			m.logSystemf("container subscribeLogs readLines id=%s at=end exit=true", id)
+			m.logSystemf("container subscribeLogs readLines id=%s stream=%s at=end exit=true", id, stream)
 			return
 		default:
 			line, err := br.ReadString('\n')
 			if err != nil && err != io.EOF {
-				m.logSystemf("container subscribeLogs readLines id=%s at=end err=%q", id, err)
+				m.logSystemf("container subscribeLogs readLines id=%s stream=%s at=end err=%q", id, stream, err)
 				return
 			} else if line != "" {
-				m.parseAndForwardLine(id, line)
+				m.parseAndForwardLine(id, stream, line, resume, ml)
 			}
 		}
 	}
 }
 
-func (m *Monitor) followDockerLogs(id string, w *io.PipeWriter, wg *sync.WaitGroup, exit chan bool) {
-	m.logSystemf("container subscribeLogs followDockerLogs id=%s at=start", id)
+// followDockerLogs writes container stdout and stderr to separate pipes so readLines knows where each line came from
+func (m *Monitor) followDockerLogs(id string, since time.Time, wout, werr *io.PipeWriter, wg *sync.WaitGroup, exit chan bool) {
+	m.logSystemf("container subscribeLogs followDockerLogs id=%s since=%d at=start", id, since.Unix())
 
 	defer wg.Done()
 
 	err := m.client.Logs(docker.LogsOptions{
-		Since:        time.Now().Unix(),
+		Since:        since.Unix(),
 		Container:    id,
 		Follow:       true,
 		Stdout:       true,
@@ -379,16 +539,19 @@ func (m *Monitor) followDockerLogs(id string, w *io.PipeWriter, wg *sync.WaitGro
 		Tail:         "all",
 		Timestamps:   true,
 		RawTerminal:  false,
-		OutputStream: w,
-		ErrorStream:  w,
+		OutputStream: wout,
+		ErrorStream:  werr,
 	})
 	if err != nil {
 		m.logSystemf("container subscribeLogs followDockerLogs id=%s count#DockerLogsError=1", id)
+		m.metrics.Count("DockerLogsError", m.dimensions(), 1)
 	}
 
-	err = w.Close()
-	if err != nil {
-		m.logSystemf("container subscribeLogs w.Close id=%s count#DockerLogsError=1", id)
+	for _, w := range []*io.PipeWriter{wout, werr} {
+		err = w.Close()
+		if err != nil {
+			m.logSystemf("container subscribeLogs w.Close id=%s count#DockerLogsError=1", id)
+		}
 	}
 
 	close(exit)
@@ -396,7 +559,9 @@ func (m *Monitor) followDockerLogs(id string, w *io.PipeWriter, wg *sync.WaitGro
 	m.logSystemf("container subscribeLogs followDockerLogs id=%s at=end", id)
 }
 
-func (m *Monitor) parseAndForwardLine(id, line string) {
+// parseAndForwardLine splits the docker timestamp off a line and forwards it,
+// through the multi-line aggregator if the container has one
+func (m *Monitor) parseAndForwardLine(id, stream, line string, resume time.Time, ml *Multiline) {
 	line = line[0 : len(line)-1] // trim off trailing newline from ReadString
 
 	// split and parse docker timestamp
@@ -413,52 +578,86 @@ func (m *Monitor) parseAndForwardLine(id, line string) {
 		}
 	}
 
+	// Docker only follows logs since a whole second so drop what was already forwarded
+	if !ts.After(resume) {
+		return
+	}
+
+	if ml != nil {
+		ml.Add(ts, line)
+		return
+	}
+
+	m.forwardLine(id, stream, ts, ts, line)
+}
+
+// forwardLine sends a record to the sinks and advances the stream checkpoint to last,
+// the timestamp of the last docker line in the record
+func (m *Monitor) forwardLine(id, stream string, ts, last time.Time, line string) {
 	env, _ := m.getEnv(id)
 
-	app := env["APP"]
-	kinesis := env["KINESIS"]
-	logGroup := env["LOG_GROUP"]
-	process := env["PROCESS"]
-	release := env["RELEASE"]
-
-	// if APP is not available for legacy reasons, fall back to inferring from LOG_GROUP or KINESIS
-	if app == "" {
-		logResource := logGroup
-		if logGroup == "" {
-			logResource = kinesis
+	if redactor, ok := m.getRedactor(id); ok && redactor != nil {
+		l, matched := redactor.Redact(line)
+
+		if len(matched) > 0 {
+			m.logSystemf("container forwardLine id=%s app=%s rules=%s count#LinesRedacted=1", id, appName(env), strings.Join(matched, ","))
+			m.metrics.Count("LinesRedacted", m.dimensions("app", appName(env), "process", env["PROCESS"]), 1)
+			line = l
 		}
+	}
+
+	// evaluate metrics on every line, including lines the rate limit will suppress
+	m.evalLogMetrics(id, env, line)
 
-		// extract app name from log resource
-		// convox-httpd-LogGroup-1KIJO8SS9F3Q9 -> convox-httpd
-		// myapp-staging-Kinesis-L6MUKT1VH451 -> myapp-staging
-		parts := strings.Split(logResource, "-")
-		if len(parts) > 2 {
-			app = strings.Join(parts[0:len(parts)-2], "-") // drop -LogGroup-YXXX
+	if limiter, ok := m.getLimiter(id); ok && limiter != nil {
+		if !limiter.Allow(len(line)) {
+			return
 		}
 	}
 
 	// count all lines we got from Docker
 	// m.logSystemf("container subscribeLogs parseAndForwardLine id=%s dim#app=%s count#Lines=1", id, app)
+	dims := m.dimensions("app", appName(env), "process", env["PROCESS"])
+	m.metrics.Count("LinesForwarded", dims, 1)
+	m.metrics.Count("BytesForwarded", dims, float64(len(line)))
+
+	m.forward(&LogRecord{
+		Timestamp:   ts,
+		App:         appName(env),
+		Process:     env["PROCESS"],
+		Release:     env["RELEASE"],
+		ContainerID: id,
+		Stream:      stream,
+		Format:      env["LOG_FORMAT"],
+		Prefix:      env["LOG_STREAM_PREFIX"] == "true",
+		Line:        []byte(line),
+	})
 
-	// append syslog-ish prefix:
-	// web:RXZMCQEPDKO/1d11a78279e0 Hello from Docker.
-	l := fmt.Sprintf("%s:%s/%s %s", process, release, id[0:12], line)
+	// the line is not delivered to CloudWatch yet, see Checkpoints
+	m.checkpoints.Set(id, stream, last)
+}
 
-	if awslogger, ok := m.getLogger(id); ok {
-		err := awslogger.Log(&logger.Message{
-			ContainerID: id,
-			Line:        []byte(l),
-			Timestamp:   ts,
-		})
-		if err != nil {
-			m.logSystemf("container subscribeLogs awslogger.Log err=%q", err)
-		}
+// appName returns the APP env of a container
+// If APP is not available for legacy reasons, fall back to inferring from LOG_GROUP or KINESIS
+func appName(env map[string]string) string {
+	if app := env["APP"]; app != "" {
+		return app
+	}
+
+	logResource := env["LOG_GROUP"]
+	if logResource == "" {
+		logResource = env["KINESIS"]
 	}
 
-	if k := env["KINESIS"]; k != "" {
-		// add timestamp to kinesis for legacy purposes
-		m.addLine(k, []byte(fmt.Sprintf("%s %s", ts.Format("2006-01-02 15:04:05"), l)))
+	// extract app name from log resource
+	// convox-httpd-LogGroup-1KIJO8SS9F3Q9 -> convox-httpd
+	// myapp-staging-Kinesis-L6MUKT1VH451 -> myapp-staging
+	parts := strings.Split(logResource, "-")
+	if len(parts) > 2 {
+		return strings.Join(parts[0:len(parts)-2], "-") // drop -LogGroup-YXXX
 	}
+
+	return ""
 }
 
 func (m *Monitor) StartAWSLogger(container *docker.Container, logGroup string) (logger.Logger, error) {
@@ -488,51 +687,6 @@ func (m *Monitor) StartAWSLogger(container *docker.Container, logGroup string) (
 	return logger, nil
 }
 
-func (m *Monitor) streamLogs() {
-	Kinesis := kinesis.New(&aws.Config{})
-
-	for _ = range time.Tick(100 * time.Millisecond) {
-		for _, stream := range m.streams() {
-			l := m.getLines(stream)
-
-			if l == nil {
-				continue
-			}
-
-			records := &kinesis.PutRecordsInput{
-				Records:    make([]*kinesis.PutRecordsRequestEntry, len(l)),
-				StreamName: aws.String(stream),
-			}
-
-			for i, line := range l {
-				records.Records[i] = &kinesis.PutRecordsRequestEntry{
-					Data:         line,
-					PartitionKey: aws.String(string(time.Now().UnixNano())),
-				}
-			}
-
-			res, err := Kinesis.PutRecords(records)
-			if err != nil {
-				m.logSystemf("container streamLogs stream=%s count#KinesisPutRecordsError=1 err=%q", stream, err)
-			}
-
-			errorCount := 0
-			errorMsg := ""
-
-			for _, r := range res.Records {
-				if r.ErrorCode != nil {
-					errorCount += 1
-					errorMsg = fmt.Sprintf("%s - %s", *r.ErrorCode, *r.ErrorMessage)
-				}
-			}
-
-			if errorCount > 0 {
-				m.logSystemf("container streamLogs stream=%s count#KinesisRecordsSuccesses=%d count#KinesisRecordsErrors=%d err=%q", stream, len(res.Records), errorCount, errorMsg)
-			}
-		}
-	}
-}
-
 func (m *Monitor) getEnv(id string) (map[string]string, bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -563,45 +717,32 @@ func (m *Monitor) setLogger(id string, l logger.Logger) {
 	m.loggers[id] = l
 }
 
-func (m *Monitor) addLine(stream string, data []byte) {
+func (m *Monitor) getRedactor(id string) (*Redactor, bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	m.lines[stream] = append(m.lines[stream], data)
+	r, ok := m.redactors[id]
+	return r, ok
 }
 
-func (m *Monitor) getLines(stream string) [][]byte {
+func (m *Monitor) setRedactor(id string, r *Redactor) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	nl := len(m.lines[stream])
-
-	if nl == 0 {
-		return nil
-	}
-
-	if nl > 500 {
-		nl = 500
-	}
-
-	ret := make([][]byte, nl)
-	copy(ret, m.lines[stream])
-	m.lines[stream] = m.lines[stream][nl:]
-
-	return ret
+	m.redactors[id] = r
 }
 
-func (m *Monitor) streams() []string {
+func (m *Monitor) getLimiter(id string) (*RateLimiter, bool) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	streams := make([]string, len(m.lines))
-	i := 0
+	l, ok := m.limiters[id]
+	return l, ok
+}
 
-	for key, _ := range m.lines {
-		streams[i] = key
-		i += 1
-	}
+func (m *Monitor) setLimiter(id string, l *RateLimiter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	return streams
+	m.limiters[id] = l
 }
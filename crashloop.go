@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CrashLoops counts failed exits per app process over a sliding window
+// A process is crash-looping when it fails more than threshold times within the window.
+// It is configured with agent env CRASH_LOOP_WINDOW (default 5m) and CRASH_LOOP_THRESHOLD (default 5).
+type CrashLoops struct {
+	Window    time.Duration
+	Threshold int
+
+	lock     sync.Mutex
+	exits    map[string][]time.Time
+	reported map[string]time.Time
+}
+
+func NewCrashLoops(window time.Duration, threshold int) *CrashLoops {
+	return &CrashLoops{
+		Window:    window,
+		Threshold: threshold,
+		exits:     map[string][]time.Time{},
+		reported:  map[string]time.Time{},
+	}
+}
+
+// Add records an exit of a process and returns the exits within the window ending now
+// looping is only true once per window so a crash loop is reported again if it carries on
+func (c *CrashLoops) Add(key string, ts, now time.Time) (exits int, looping bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	recent := []time.Time{}
+
+	for _, t := range append(c.exits[key], ts) {
+		if now.Sub(t) <= c.Window {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) == 0 {
+		delete(c.exits, key)
+		return 0, false
+	}
+
+	c.exits[key] = recent
+
+	if len(recent) <= c.Threshold {
+		return len(recent), false
+	}
+
+	if last, ok := c.reported[key]; ok && now.Sub(last) < c.Window {
+		return len(recent), false
+	}
+
+	c.reported[key] = now
+
+	return len(recent), true
+}
+
+// checkCrashLoop reports a process that keeps failing with an app event and a CrashLoop metric
+func (m *Monitor) checkCrashLoop(id string, exitCode int, oomKilled bool, finished time.Time) {
+	// a clean exit is a finished one-off process or deploy, not a crash
+	if exitCode == 0 && !oomKilled {
+		return
+	}
+
+	env, ok := m.getEnv(id)
+	if !ok || env["PROCESS"] == "" {
+		return
+	}
+
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+
+	app, process := appName(env), env["PROCESS"]
+
+	exits, looping := m.crashLoops.Add(app+"/"+process, finished, time.Now())
+	if !looping {
+		return
+	}
+
+	m.logSystemf("container checkCrashLoop id=%s app=%s process=%s exits=%d exitCode=%d oomKilled=%t count#CrashLoop=1", id, app, process, exits, exitCode, oomKilled)
+	m.metrics.Count("CrashLoop", m.dimensions("app", app, "process", process, "exitCode", fmt.Sprintf("%d", exitCode), "oomKilled", fmt.Sprintf("%t", oomKilled)), 1)
+
+	last := fmt.Sprintf("last exit code %d", exitCode)
+	if oomKilled {
+		last += ", OOMKilled"
+	}
+
+	m.logAppEvent(id, fmt.Sprintf("%s process is crash-looping (%d exits in %s, %s)", process, exits, shortDuration(m.crashLoops.Window), last))
+}
+
+// shortDuration formats round durations without trailing zero units, i.e. 5m instead of 5m0s
+func shortDuration(d time.Duration) string {
+	s := d.String()
+
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+
+	return s
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrashLoops(t *testing.T) {
+	c := NewCrashLoops(5*time.Minute, 2)
+	now := time.Date(2016, 4, 20, 17, 59, 27, 0, time.UTC)
+
+	// an exit from before the window does not count
+	exits, looping := c.Add("myapp/web", now.Add(-10*time.Minute), now)
+	assert.Equal(t, 0, exits)
+	assert.False(t, looping)
+
+	exits, looping = c.Add("myapp/web", now.Add(-4*time.Minute), now)
+	assert.Equal(t, 1, exits)
+	assert.False(t, looping)
+
+	exits, looping = c.Add("myapp/web", now.Add(-1*time.Minute), now)
+	assert.Equal(t, 2, exits)
+	assert.False(t, looping)
+
+	exits, looping = c.Add("myapp/web", now, now)
+	assert.Equal(t, 3, exits)
+	assert.True(t, looping)
+
+	// only reported once per window
+	exits, looping = c.Add("myapp/web", now.Add(1*time.Minute), now.Add(1*time.Minute))
+	assert.Equal(t, 4, exits)
+	assert.False(t, looping)
+
+	exits, looping = c.Add("myapp/worker", now, now)
+	assert.Equal(t, 1, exits)
+	assert.False(t, looping)
+}
+
+func TestShortDuration(t *testing.T) {
+	assert.Equal(t, "5m", shortDuration(5*time.Minute))
+	assert.Equal(t, "1h", shortDuration(1*time.Hour))
+	assert.Equal(t, "1m30s", shortDuration(90*time.Second))
+}
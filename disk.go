@@ -5,7 +5,6 @@ import (
 	"os/exec"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/docker/go-units"
 )
@@ -13,40 +12,53 @@ import (
 // Monitor Disk Metrics for Instance
 // Currently this only accurrately reports disk usage on the Amazon ECS AMI and the devicemapper driver
 // not Docker Machine, boot2docker and aufs driver
-func (m *Monitor) Disk() {
-	m.logSystemf("disk at=start")
-
-	for _ = range time.Tick(MONITOR_INTERVAL) {
-		// Report Docker utilization
-		a, t, u, docker_util, err := m.DockerUtilization()
-		if err != nil {
-			m.logSystemf("disk DockerUtilization err=%q", err)
-			m.ReportError(err)
-		} else {
-			m.logSystemf("disk DockerUtilization dim#volume=docker dim#instanceId=%s sample#disk.available=%.4fgB sample#disk.total=%.4fgB sample#disk.used=%.4fgB sample#disk.utilization=%.2f%%", m.instanceId, a, t, u, docker_util)
-		}
+func (m *Monitor) checkDisk() (HealthStatus, string) {
+	status, detail := HealthOK, ""
 
-		// If disk is over 80.0 full, delete docker containers and images in attempt to reclaim space
-		if docker_util > 80.0 {
-			m.RemoveDockerArtifacts()
-		}
+	// Report Docker utilization
+	a, t, u, docker_util, err := m.DockerUtilization()
+	if err != nil {
+		// only devicemapper reports docker volume usage so this is not a health problem
+		m.logSystemf("disk DockerUtilization err=%q", err)
+		m.ReportError(err)
+	} else {
+		m.logSystemf("disk DockerUtilization dim#volume=docker dim#instanceId=%s sample#disk.available=%.4fgB sample#disk.total=%.4fgB sample#disk.used=%.4fgB sample#disk.utilization=%.2f%%", m.instanceId, a, t, u, docker_util)
+		m.diskMetrics("docker", a, t, u, docker_util)
+	}
 
-		// Report root volume utilization after artifacts have possibly been removed
-		path := "/mnt/host_root"
-		a, t, u, root_util, err := m.PathUtilization(path)
-		if err != nil {
-			m.logSystemf("disk PathUtilization path=%s err=%q", path, err)
-			m.ReportError(err)
-		} else {
-			m.logSystemf("disk PathUtilization dim#volume=root dim#instanceId=%s sample#disk.available=%.4fgB sample#disk.total=%.4fgB sample#disk.used=%.4fgB sample#disk.utilization=%.2f%%", m.instanceId, a, t, u, root_util)
-		}
+	// If disk is over 80.0 full, delete docker containers and images in attempt to reclaim space
+	if docker_util > 80.0 {
+		m.RemoveDockerArtifacts()
+	}
 
-		// when root disk is very close to full, we expect degraded performance
-		// and problems launching new containers. Terminate.
-		if root_util >= 98.0 {
-			m.SetUnhealthy("disk", fmt.Errorf("root volume is %.2f%% full", root_util))
-		}
+	// Report root volume utilization after artifacts have possibly been removed
+	path := "/mnt/host_root"
+	a, t, u, root_util, err := m.PathUtilization(path)
+	if err != nil {
+		m.logSystemf("disk PathUtilization path=%s err=%q", path, err)
+		m.ReportError(err)
+		status, detail = HealthWarning, err.Error()
+	} else {
+		m.logSystemf("disk PathUtilization dim#volume=root dim#instanceId=%s sample#disk.available=%.4fgB sample#disk.total=%.4fgB sample#disk.used=%.4fgB sample#disk.utilization=%.2f%%", m.instanceId, a, t, u, root_util)
+		m.diskMetrics("root", a, t, u, root_util)
+	}
+
+	// when root disk is very close to full, we expect degraded performance
+	// and problems launching new containers. Terminate.
+	if root_util >= 98.0 {
+		return HealthFailed, fmt.Sprintf("root volume is %.2f%% full", root_util)
 	}
+
+	return status, detail
+}
+
+func (m *Monitor) diskMetrics(volume string, avail, total, used, util float64) {
+	dims := m.dimensions("volume", volume)
+
+	m.metrics.Gauge("disk.available", dims, avail)
+	m.metrics.Gauge("disk.total", dims, total)
+	m.metrics.Gauge("disk.used", dims, used)
+	m.metrics.Gauge("disk.utilization", dims, util)
 }
 
 func (m *Monitor) DockerUtilization() (avail, total, used, util float64, err error) {
@@ -124,6 +136,7 @@ func (m *Monitor) PathUtilization(path string) (avail, total, used, util float64
 // This will blow away build or run cache but hopefully preserve disk space.
 func (m *Monitor) RemoveDockerArtifacts() {
 	m.logSystemf("disk RemoveDockerArtifacts at=start count#docker.rm=1")
+	m.metrics.Count("docker.rm", m.dimensions(), 1)
 	m.run(`docker rm -v $(docker ps -a -q)`)
 	m.run(`docker rmi -f $(docker images -a -q)`)
 }
@@ -1,33 +1,309 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// grep dmesg for file system error strings
-// if grep exits 0 it was a match so we mark the instance unhealthy
-// if grep exits 1 there was no match so we carry on
+// DmesgRule acts on kernel log lines matching a pattern
+//
+// Actions escalate, every action also does the ones before it:
+//
+// log        log the line to the convox log group
+// metric     count a DmesgMatch metric with rule and severity dimensions
+// report     report the line to rollbar
+// unhealthy  mark the instance unhealthy so the autoscaling group replaces it
+// drain      set the ECS container instance to DRAINING so tasks move off it
+type DmesgRule struct {
+	Name     string
+	Severity string
+	Action   string
+	re       *regexp.Regexp
+}
+
+var dmesgActions = map[string]int{"log": 0, "metric": 1, "report": 2, "unhealthy": 3, "drain": 4}
+
+var dmesgSeverities = map[string]bool{"info": true, "warning": true, "error": true, "critical": true}
+
+// DefaultDmesgRules cover file system, disk and CPU problems seen on cluster instances
+// Rules from DMESG_RULES_FILE or the DMESG_RULES env replace defaults with the same name.
+var DefaultDmesgRules = []string{
+	`fs-readonly critical unhealthy Remounting filesystem read-only`,
+	`zfs-readonly critical unhealthy switching pool to read-only mode`,
+	`ext4-error error report EXT4-fs error`,
+	`xfs-error error report XFS \(.*\): (Corruption|metadata I/O error|Log I/O Error)`,
+	`hung-task warning metric blocked for more than \d+ seconds`,
+	`nvme-timeout error metric nvme\d+: I/O \d+ QID \d+ timeout`,
+	`soft-lockup critical report soft lockup - CPU#\d+ stuck`,
+}
+
+// dmesgRuleDef splits a rule definition on whitespace into name, severity, action and the rest of the line
+var dmesgRuleDef = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(\S+)\s+(.+)$`)
+
+// ParseDmesgRule parses a rule definition: <name> <severity> <action> <regex>
+func ParseDmesgRule(def string) (*DmesgRule, error) {
+	match := dmesgRuleDef.FindStringSubmatch(strings.TrimSpace(def))
+	if match == nil {
+		return nil, fmt.Errorf("invalid dmesg rule: %s", def)
+	}
+
+	parts := match[1:]
+
+	if !dmesgSeverities[parts[1]] {
+		return nil, fmt.Errorf("invalid dmesg rule %s: unknown severity %s", parts[0], parts[1])
+	}
+
+	if _, ok := dmesgActions[parts[2]]; !ok {
+		return nil, fmt.Errorf("invalid dmesg rule %s: unknown action %s", parts[0], parts[2])
+	}
+
+	re, err := regexp.Compile(strings.TrimSpace(parts[3]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid dmesg rule %s: %s", parts[0], err)
+	}
+
+	return &DmesgRule{Name: parts[0], Severity: parts[1], Action: parts[2], re: re}, nil
+}
+
+// ParseDmesgRules parses one rule per line, skipping blank lines and # comments
+func ParseDmesgRules(defs string) ([]*DmesgRule, error) {
+	rules := []*DmesgRule{}
+
+	for _, def := range strings.Split(defs, "\n") {
+		def = strings.TrimSpace(def)
+
+		if def == "" || strings.HasPrefix(def, "#") {
+			continue
+		}
+
+		r, err := ParseDmesgRule(def)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// NewDmesgRules returns the default rules merged with custom ones, sorted by name
+func NewDmesgRules(custom string) ([]*DmesgRule, error) {
+	byName := map[string]*DmesgRule{}
+
+	for _, defs := range []string{strings.Join(DefaultDmesgRules, "\n"), custom} {
+		rules, err := ParseDmesgRules(defs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range rules {
+			byName[r.Name] = r
+		}
+	}
+
+	names := []string{}
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rules := []*DmesgRule{}
+	for _, name := range names {
+		rules = append(rules, byName[name])
+	}
+
+	return rules, nil
+}
+
+// matchDmesgRule returns the first rule that matches a line
+func matchDmesgRule(rules []*DmesgRule, line string) (*DmesgRule, bool) {
+	for _, r := range rules {
+		if r.re.MatchString(line) {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+// Dmesg follows kernel messages from /dev/kmsg and checks them against the dmesg rules
+// If /dev/kmsg is not readable it falls back to checking new dmesg lines every interval
 func (m *Monitor) Dmesg() {
 	m.logSystemf("dmesg at=start")
 
+	rules := m.dmesgRules()
+
+	if err := m.followKmsg(rules); err != nil {
+		m.logSystemf("dmesg followKmsg count#KmsgError=1 err=%q", err)
+		m.metrics.Count("KmsgError", m.dimensions(), 1)
+	}
+
+	m.pollDmesg(rules)
+}
+
+// dmesgRules returns the default rules merged with DMESG_RULES and DMESG_RULES_FILE
+func (m *Monitor) dmesgRules() []*DmesgRule {
+	custom := os.Getenv("DMESG_RULES")
+
+	if path := os.Getenv("DMESG_RULES_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			m.logSystemf("dmesg ReadFile path=%s count#DmesgRulesError=1 err=%q", path, err)
+			m.metrics.Count("DmesgRulesError", m.dimensions(), 1)
+		}
+
+		custom += "\n" + string(data)
+	}
+
+	rules, err := NewDmesgRules(custom)
+	if err != nil {
+		m.logSystemf("dmesg NewDmesgRules count#DmesgRulesError=1 err=%q", err)
+		m.metrics.Count("DmesgRulesError", m.dimensions(), 1)
+
+		rules, _ = NewDmesgRules("")
+	}
+
+	return rules
+}
+
+// pollDmesg checks new dmesg lines against the rules every interval
+// The timestamp of the last line checked is kept next to KMSG_STATE_FILE so lines are only acted on once,
+// even across agent restarts.
+func (m *Monitor) pollDmesg(rules []*DmesgRule) {
+	statePath := kmsgStatePath() + ".dmesg"
+	state := loadKmsgState(statePath, bootId())
+	drained := false
+	oom := &OOMParser{}
+
+	m.logSystemf("dmesg pollDmesg path=%s mark=%d", statePath, state.seq)
+
 	for _ = range time.Tick(MONITOR_INTERVAL) {
-		m.grep("Remounting filesystem read-only")
-		m.grep("switching pool to read-only mode")
+		out, err := exec.Command("dmesg").CombinedOutput()
+		if err != nil {
+			m.logSystemf("dmesg exec.Command count#DmesgError=1 err=%q", err)
+			m.metrics.Count("DmesgError", m.dimensions(), 1)
+			continue
+		}
+
+		lines, mark := newDmesgLines(out, state.seq)
+
+		for _, line := range lines {
+			if k, ok := oom.Feed(line); ok {
+				m.handleKernelOOM(k)
+			}
+
+			if r, ok := matchDmesgRule(rules, line); ok {
+				drained = m.handleDmesgRule(r, line, drained)
+			}
+		}
+
+		if mark == state.seq {
+			continue
+		}
+
+		state.seq = mark
+
+		if err := state.save(true); err != nil {
+			m.logSystemf("dmesg pollDmesg path=%s count#KmsgStateError=1 err=%q", statePath, err)
+		}
+	}
+}
+
+var dmesgTimestamp = regexp.MustCompile(`^\[\s*(\d+)\.(\d{6})\]`)
+
+// newDmesgLines returns the dmesg lines after the mark, a timestamp in microseconds since boot,
+// and the timestamp of the last line. Lines without a timestamp belong to the line before them.
+func newDmesgLines(out []byte, mark uint64) ([]string, uint64) {
+	lines := []string{}
+	last := mark
+	current := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := dmesgTimestamp.FindStringSubmatch(line); match != nil {
+			sec, _ := strconv.ParseUint(match[1], 10, 64)
+			usec, _ := strconv.ParseUint(match[2], 10, 64)
+
+			ts := sec*1000000 + usec
+			current = ts > mark
+
+			if ts > last {
+				last = ts
+			}
+		}
+
+		if current {
+			lines = append(lines, line)
+		}
 	}
+
+	return lines, last
 }
 
-func (m *Monitor) grep(pattern string) {
-	m.logSystemf("dmesg grep pattern=%q at=start", pattern)
+// handleDmesgRule takes the rule action for a matching line and returns true if the instance was drained
+func (m *Monitor) handleDmesgRule(r *DmesgRule, line string, drained bool) bool {
+	level := dmesgActions[r.Action]
+
+	m.logSystemf("dmesg rule=%s severity=%s action=%s line=%q", r.Name, r.Severity, r.Action, line)
+
+	if level >= dmesgActions["metric"] {
+		m.logSystemf("dmesg rule=%s dim#rule=%s dim#severity=%s count#DmesgMatch=1", r.Name, r.Name, r.Severity)
+		m.metrics.Count("DmesgMatch", m.dimensions("rule", r.Name, "severity", r.Severity), 1)
+	}
+
+	if level == dmesgActions["report"] {
+		m.ReportError(errors.New(line))
+	}
+
+	// the dmesg health check marks the instance unhealthy and reports the error
+	if level >= dmesgActions["unhealthy"] {
+		m.setDmesgFailure(line)
+	}
 
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("dmesg | grep %q", pattern))
-	out, err := cmd.CombinedOutput()
+	// draining is tried again on the next matching line if it fails
+	if level >= dmesgActions["drain"] && !drained {
+		if err := m.drainInstance(); err != nil {
+			m.logSystemf("dmesg rule=%s drainInstance count#DmesgDrainError=1 err=%q", r.Name, err)
+			m.metrics.Count("DmesgDrainError", m.dimensions(), 1)
+			return false
+		}
 
-	// grep returned 0
-	if err == nil {
-		m.SetUnhealthy("dmesg", fmt.Errorf(string(out)))
-	} else {
-		m.logSystemf("dmesg ok=true")
+		return true
 	}
+
+	return drained
+}
+
+// checkDmesg fails once a kernel message matched an unhealthy rule
+// Problems like a read-only file system do not go away so the check keeps failing.
+func (m *Monitor) checkDmesg() (HealthStatus, string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.dmesgFailure != "" {
+		return HealthFailed, m.dmesgFailure
+	}
+
+	return HealthOK, ""
+}
+
+func (m *Monitor) setDmesgFailure(line string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.dmesgFailure = line
 }
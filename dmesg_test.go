@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDmesgRules(t *testing.T) {
+	rules, err := NewDmesgRules(`
+# downgrade a default and add a custom rule
+hung-task info log blocked for more than \d+ seconds
+oom warning metric Out of memory: Kill process \d+
+`)
+	assert.Nil(t, err)
+
+	r, ok := matchDmesgRule(rules, "[ 2400.123456] INFO: task java:1234 blocked for more than 120 seconds.")
+	assert.True(t, ok)
+	assert.Equal(t, "hung-task", r.Name)
+	assert.Equal(t, "info", r.Severity)
+	assert.Equal(t, "log", r.Action)
+
+	r, ok = matchDmesgRule(rules, "[ 2401.000000] Out of memory: Kill process 4321 (java) score 900 or sacrifice child")
+	assert.True(t, ok)
+	assert.Equal(t, "oom", r.Name)
+
+	r, ok = matchDmesgRule(rules, "[   12.345678] EXT4-fs (xvda1): Remounting filesystem read-only")
+	assert.True(t, ok)
+	assert.Equal(t, "fs-readonly", r.Name)
+	assert.Equal(t, "unhealthy", r.Action)
+
+	r, ok = matchDmesgRule(rules, "[ 3600.000000] nvme0: I/O 12 QID 3 timeout, aborting")
+	assert.True(t, ok)
+	assert.Equal(t, "nvme-timeout", r.Name)
+
+	_, ok = matchDmesgRule(rules, "[    0.000000] Initializing cgroup subsys cpuset")
+	assert.False(t, ok)
+}
+
+func TestParseDmesgRuleErrors(t *testing.T) {
+	_, err := ParseDmesgRule("hung-task info")
+	assert.EqualError(t, err, "invalid dmesg rule: hung-task info")
+
+	_, err = ParseDmesgRule("hung-task urgent log blocked")
+	assert.EqualError(t, err, "invalid dmesg rule hung-task: unknown severity urgent")
+
+	_, err = ParseDmesgRule("hung-task info reboot blocked")
+	assert.EqualError(t, err, "invalid dmesg rule hung-task: unknown action reboot")
+}
+
+func TestParseDmesgRuleWhitespace(t *testing.T) {
+	r, err := ParseDmesgRule("hung-task  warning\tmetric   blocked for more than \\d+ seconds")
+	assert.Nil(t, err)
+	assert.Equal(t, "hung-task", r.Name)
+	assert.Equal(t, "warning", r.Severity)
+	assert.Equal(t, "metric", r.Action)
+	assert.Equal(t, `blocked for more than \d+ seconds`, r.re.String())
+}
+
+func TestNewDmesgLines(t *testing.T) {
+	out := []byte(`[    0.000000] Initializing cgroup subsys cpuset
+[   12.345678] EXT4-fs (xvda1): Remounting filesystem read-only
+[ 2400.123456] INFO: task java:1234 blocked for more than 120 seconds.
+      Tainted: G            E   4.4.5-15.26.amzn1.x86_64 #1
+`)
+
+	lines, mark := newDmesgLines(out, 0)
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, uint64(2400123456), mark)
+
+	// after a restart only lines after the saved mark are acted on again
+	lines, mark = newDmesgLines(out, 12345678)
+	assert.Equal(t, []string{
+		"[ 2400.123456] INFO: task java:1234 blocked for more than 120 seconds.",
+		"      Tainted: G            E   4.4.5-15.26.amzn1.x86_64 #1",
+	}, lines)
+	assert.Equal(t, uint64(2400123456), mark)
+
+	lines, mark = newDmesgLines(out, 2400123456)
+	assert.Equal(t, 0, len(lines))
+	assert.Equal(t, uint64(2400123456), mark)
+}
@@ -9,42 +9,43 @@ import (
 // try `docker ps` 5 times
 // if it returns normally once, consider the system healthy
 // if it hangs for >30s every time, consider the system unhealthy
-func (m *Monitor) Docker() {
-	m.logSystemf("docker at=start")
+func (m *Monitor) checkDocker() (HealthStatus, string) {
+	var err error
 
-	for _ = range time.Tick(MONITOR_INTERVAL) {
-		var err error
-		unhealthy := true
+	for i := 0; i < 5; i++ {
+		m.logSystemf("docker exec.Command args=ps try=%d", i)
 
-		for i := 0; i < 5; i++ {
-			m.logSystemf("docker exec.Command args=ps try=%d", i)
+		cmd := exec.Command("docker", "ps")
+		start := time.Now()
 
-			cmd := exec.Command("docker", "ps")
+		if err := cmd.Start(); err != nil {
+			m.logSystemf("docker exec.Command args=ps try=%d count#DockerPsError=1 err=%q", i, err)
+			m.metrics.Count("DockerPsError", m.dimensions(), 1)
+			continue
+		}
 
-			if err := cmd.Start(); err != nil {
-				m.logSystemf("docker exec.Command args=ps try=%d count#DockerPsError=1 err=%q", i, err)
-				continue
-			}
+		timer := time.AfterFunc(30*time.Second, func() {
+			cmd.Process.Kill()
+		})
 
-			timer := time.AfterFunc(30*time.Second, func() {
-				cmd.Process.Kill()
-			})
+		err = cmd.Wait()
+		timer.Stop()
 
-			err = cmd.Wait()
-			timer.Stop()
+		m.metrics.Observe("DockerPsLatency", m.dimensions(), time.Since(start).Seconds())
 
-			// docker ps command returned 0
-			if err == nil {
-				unhealthy = false
-				break
-			}
+		// docker ps command returned 0
+		if err == nil {
+			m.metrics.Gauge("DockerHealthy", m.dimensions(), 1)
+			return HealthOK, ""
 		}
+	}
 
-		// docker ps never ran without error
-		if unhealthy {
-			m.SetUnhealthy("docker", err)
-		} else {
-			m.logSystemf("docker ok=true")
-		}
+	// docker ps never ran without error
+	m.metrics.Gauge("DockerHealthy", m.dimensions(), 0)
+
+	if err == nil {
+		return HealthFailed, "docker ps could not be started"
 	}
+
+	return HealthFailed, err.Error()
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// signal names for exit codes over 128, i.e. 137 is 128 + SIGKILL
+var exitSignals = map[int]string{
+	1:  "SIGHUP",
+	2:  "SIGINT",
+	3:  "SIGQUIT",
+	4:  "SIGILL",
+	6:  "SIGABRT",
+	7:  "SIGBUS",
+	8:  "SIGFPE",
+	9:  "SIGKILL",
+	11: "SIGSEGV",
+	13: "SIGPIPE",
+	14: "SIGALRM",
+	15: "SIGTERM",
+}
+
+// exitInfo describes why and when a container stopped
+type exitInfo struct {
+	ExitCode  int
+	Signal    string
+	OOMKilled bool
+	Started   time.Time
+	Finished  time.Time
+	Duration  time.Duration
+}
+
+func newExitInfo(state docker.State) *exitInfo {
+	e := &exitInfo{
+		ExitCode:  state.ExitCode,
+		OOMKilled: state.OOMKilled,
+		Started:   state.StartedAt,
+		Finished:  state.FinishedAt,
+	}
+
+	if n := state.ExitCode - 128; n > 0 {
+		e.Signal = exitSignals[n]
+		if e.Signal == "" {
+			e.Signal = fmt.Sprintf("SIG%d", n)
+		}
+	}
+
+	if !e.Started.IsZero() && e.Finished.After(e.Started) {
+		e.Duration = e.Finished.Sub(e.Started)
+	}
+
+	return e
+}
+
+// Clean is a zero exit that was not killed for running out of memory
+func (e *exitInfo) Clean() bool {
+	return e.ExitCode == 0 && !e.OOMKilled
+}
+
+// Message describes the exit for app logs, i.e.
+// Exited web process 1d11a78279e0 cleanly after 5m3s
+// Dead web process 1d11a78279e0 (exit code 137, SIGKILL, OOMKilled) after 2m13s
+func (e *exitInfo) Message(process, id string) string {
+	var msg string
+
+	if e.Clean() {
+		msg = fmt.Sprintf("Exited %s %s cleanly", process, id)
+	} else {
+		reasons := []string{fmt.Sprintf("exit code %d", e.ExitCode)}
+
+		if e.Signal != "" {
+			reasons = append(reasons, e.Signal)
+		}
+
+		if e.OOMKilled {
+			reasons = append(reasons, "OOMKilled")
+		}
+
+		msg = fmt.Sprintf("Dead %s %s (%s)", process, id, strings.Join(reasons, ", "))
+	}
+
+	if e.Duration > 0 {
+		// whole seconds unless it ran for less than one
+		d := e.Duration - e.Duration%time.Second
+		if d == 0 {
+			d = e.Duration - e.Duration%time.Millisecond
+		}
+
+		msg += fmt.Sprintf(" after %s", d)
+	}
+
+	return msg
+}
+
+// Fields are the structured details of the exit for JSON app logs
+func (e *exitInfo) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"clean":      e.Clean(),
+		"exit_code":  e.ExitCode,
+		"oom_killed": e.OOMKilled,
+	}
+
+	if e.Signal != "" {
+		fields["signal"] = e.Signal
+	}
+
+	if !e.Started.IsZero() {
+		fields["started_at"] = e.Started.UTC().Format(time.RFC3339Nano)
+	}
+
+	if !e.Finished.IsZero() {
+		fields["finished_at"] = e.Finished.UTC().Format(time.RFC3339Nano)
+	}
+
+	if e.Duration > 0 {
+		fields["duration_seconds"] = e.Duration.Seconds()
+	}
+
+	return fields
+}
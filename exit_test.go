@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitInfo(t *testing.T) {
+	started := time.Date(2016, 4, 20, 17, 59, 27, 0, time.UTC)
+
+	e := newExitInfo(docker.State{
+		ExitCode:   137,
+		OOMKilled:  true,
+		StartedAt:  started,
+		FinishedAt: started.Add(133*time.Second + 250*time.Millisecond),
+	})
+
+	assert.False(t, e.Clean())
+	assert.Equal(t, "SIGKILL", e.Signal)
+	assert.Equal(t, "Dead web process 1d11a78279e0 (exit code 137, SIGKILL, OOMKilled) after 2m13s", e.Message("web process", "1d11a78279e0"))
+	assert.Equal(t, map[string]interface{}{
+		"clean":            false,
+		"exit_code":        137,
+		"signal":           "SIGKILL",
+		"oom_killed":       true,
+		"started_at":       "2016-04-20T17:59:27Z",
+		"finished_at":      "2016-04-20T18:01:40.25Z",
+		"duration_seconds": 133.25,
+	}, e.Fields())
+
+	e = newExitInfo(docker.State{ExitCode: 0, StartedAt: started, FinishedAt: started.Add(5 * time.Minute)})
+
+	assert.True(t, e.Clean())
+	assert.Equal(t, "Exited process 1d11a78279e0 cleanly after 5m0s", e.Message("process", "1d11a78279e0"))
+
+	// no timestamps when docker has not recorded them
+	e = newExitInfo(docker.State{ExitCode: 1})
+
+	assert.Equal(t, "Dead process 1d11a78279e0 (exit code 1)", e.Message("process", "1d11a78279e0"))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HealthStatus string
+
+const (
+	HealthOK      HealthStatus = "ok"
+	HealthWarning HealthStatus = "warning"
+	HealthFailed  HealthStatus = "failed"
+)
+
+// HealthCheck is a periodic check of some part of the instance
+// Run returns a status and a human readable detail, i.e. "root volume is 98.50% full"
+type HealthCheck interface {
+	Name() string
+	Interval() time.Duration
+	Run() (HealthStatus, string)
+}
+
+// NewHealthCheck makes a HealthCheck from a function
+func NewHealthCheck(name string, interval time.Duration, run func() (HealthStatus, string)) HealthCheck {
+	return &funcHealthCheck{name: name, interval: interval, run: run}
+}
+
+type funcHealthCheck struct {
+	name     string
+	interval time.Duration
+	run      func() (HealthStatus, string)
+}
+
+func (c *funcHealthCheck) Name() string                { return c.name }
+func (c *funcHealthCheck) Interval() time.Duration     { return c.interval }
+func (c *funcHealthCheck) Run() (HealthStatus, string) { return c.run() }
+
+// HealthResult is the latest outcome of a check
+type HealthResult struct {
+	Name      string       `json:"name"`
+	Status    HealthStatus `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Failures  int          `json:"failures"`
+	Threshold int          `json:"threshold"`
+	Unhealthy bool         `json:"unhealthy"`
+	Checked   time.Time    `json:"checked"`
+}
+
+// Health is the registry of checks and their latest results
+// A check has to fail Threshold times in a row before the instance is marked unhealthy.
+// Every failed run past the threshold is acted on until marking the instance unhealthy succeeds.
+type Health struct {
+	lock    sync.Mutex
+	checks  []HealthCheck
+	results map[string]*HealthResult
+}
+
+func NewHealth() *Health {
+	return &Health{results: map[string]*HealthResult{}}
+}
+
+// Register adds a check that fails after threshold consecutive failures
+func (h *Health) Register(c HealthCheck, threshold int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	h.checks = append(h.checks, c)
+	h.results[c.Name()] = &HealthResult{Name: c.Name(), Status: HealthOK, Threshold: threshold}
+}
+
+// Record stores the outcome of a check run and returns true when it is past its failure threshold
+// and the instance has not been marked unhealthy for it yet
+func (h *Health) Record(name string, status HealthStatus, detail string, ts time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.results[name]
+	if !ok {
+		return false
+	}
+
+	r.Status = status
+	r.Detail = detail
+	r.Checked = ts
+
+	if status != HealthFailed {
+		r.Failures = 0
+		r.Unhealthy = false
+		return false
+	}
+
+	r.Failures += 1
+
+	return r.Failures >= r.Threshold && !r.Unhealthy
+}
+
+// MarkUnhealthy records that the instance was marked unhealthy for a check
+// It is reset when the check passes again.
+func (h *Health) MarkUnhealthy(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if r, ok := h.results[name]; ok {
+		r.Unhealthy = true
+	}
+}
+
+// Status returns the worst status of all checks and their results sorted by name
+// A failing check only makes the aggregate failed once it crosses its threshold.
+func (h *Health) Status() (HealthStatus, []HealthResult) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	status := HealthOK
+	results := []HealthResult{}
+
+	for _, r := range h.results {
+		results = append(results, *r)
+
+		switch {
+		case r.Unhealthy, r.Status == HealthFailed && r.Failures >= r.Threshold:
+			status = HealthFailed
+		case r.Status != HealthOK && status == HealthOK:
+			status = HealthWarning
+		}
+	}
+
+	sort.Sort(healthResultsByName(results))
+
+	return status, results
+}
+
+// RegisterHealthCheck adds a check with its threshold from the HEALTH_<NAME>_THRESHOLD env (default 1)
+func (m *Monitor) RegisterHealthCheck(c HealthCheck) {
+	threshold := envInt(fmt.Sprintf("HEALTH_%s_THRESHOLD", strings.ToUpper(c.Name())), 1)
+	m.health.Register(c, threshold)
+}
+
+// HealthChecks runs every registered check on its own interval
+func (m *Monitor) HealthChecks() {
+	m.health.lock.Lock()
+	checks := append([]HealthCheck{}, m.health.checks...)
+	m.health.lock.Unlock()
+
+	for _, c := range checks {
+		go m.runHealthCheck(c)
+	}
+}
+
+func (m *Monitor) runHealthCheck(c HealthCheck) {
+	name := c.Name()
+
+	m.logSystemf("%s at=start", name)
+
+	for _ = range time.Tick(c.Interval()) {
+		status, detail := c.Run()
+
+		act := m.health.Record(name, status, detail, time.Now())
+
+		switch status {
+		case HealthOK:
+			m.logSystemf("%s ok=true", name)
+		case HealthWarning:
+			m.logSystemf("%s ok=warning detail=%q", name, detail)
+		case HealthFailed:
+			m.logSystemf("%s ok=false detail=%q count#HealthCheckFailure=1", name, detail)
+			m.metrics.Count("HealthCheckFailure", m.dimensions("check", name), 1)
+		}
+
+		// a failed AutoScaling call is retried on the next failed run
+		if act {
+			if err := m.SetUnhealthy(name, errors.New(detail)); err == nil {
+				m.health.MarkUnhealthy(name)
+			}
+		}
+	}
+}
+
+type healthResultsByName []HealthResult
+
+func (a healthResultsByName) Len() int           { return len(a) }
+func (a healthResultsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a healthResultsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth()
+	ok := func() (HealthStatus, string) { return HealthOK, "" }
+
+	h.Register(NewHealthCheck("docker", time.Minute, ok), 2)
+	h.Register(NewHealthCheck("disk", time.Minute, ok), 1)
+
+	now := time.Now()
+
+	status, results := h.Status()
+	assert.Equal(t, HealthOK, status)
+	assert.Equal(t, "disk", results[0].Name)
+	assert.Equal(t, "docker", results[1].Name)
+
+	// a warning does not count towards the threshold
+	assert.False(t, h.Record("disk", HealthWarning, "no such file or directory", now))
+
+	status, _ = h.Status()
+	assert.Equal(t, HealthWarning, status)
+
+	// the first failure is under the threshold
+	assert.False(t, h.Record("docker", HealthFailed, "signal: killed", now))
+
+	status, results = h.Status()
+	assert.Equal(t, HealthWarning, status)
+	assert.Equal(t, 1, results[1].Failures)
+
+	// failures past the threshold are acted on until the instance is marked unhealthy
+	assert.True(t, h.Record("docker", HealthFailed, "signal: killed", now))
+
+	status, results = h.Status()
+	assert.Equal(t, HealthFailed, status)
+	assert.False(t, results[1].Unhealthy)
+
+	// i.e. SetInstanceHealth failed so the next failure tries again
+	assert.True(t, h.Record("docker", HealthFailed, "signal: killed", now))
+
+	h.MarkUnhealthy("docker")
+	assert.False(t, h.Record("docker", HealthFailed, "signal: killed", now))
+
+	status, results = h.Status()
+	assert.Equal(t, HealthFailed, status)
+	assert.True(t, results[1].Unhealthy)
+	assert.Equal(t, "signal: killed", results[1].Detail)
+
+	// passing resets the failures
+	assert.False(t, h.Record("docker", HealthOK, "", now))
+	assert.False(t, h.Record("disk", HealthOK, "", now))
+
+	status, results = h.Status()
+	assert.Equal(t, HealthOK, status)
+	assert.Equal(t, 0, results[1].Failures)
+}
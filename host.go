@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostStats is a sample of the host /proc counters
+type hostStats struct {
+	time time.Time
+
+	load1, load5, load15 float64
+
+	meminfo map[string]uint64 // bytes
+
+	cpuTotal uint64 // jiffies
+	cpuSteal uint64
+	ctxt     uint64
+
+	netErrors uint64
+	netDrops  uint64
+
+	vmstat map[string]uint64
+
+	pressure map[string]float64 // avg10 of "some" stalls, missing on kernels without PSI
+}
+
+// Host periodically reports load, memory, swap, CPU steal, context switches, network errors and
+// pressure stalls read from the host /proc (HOST_PROC, default /mnt/host_root/proc)
+func (m *Monitor) Host() {
+	m.logSystemf("host at=start")
+
+	proc := os.Getenv("HOST_PROC")
+	if proc == "" {
+		proc = "/mnt/host_root/proc"
+	}
+
+	prev, err := readHostStats(proc)
+	if err != nil {
+		m.logSystemf("host readHostStats proc=%s err=%q", proc, err)
+	}
+
+	for _ = range time.Tick(MONITOR_INTERVAL) {
+		cur, err := readHostStats(proc)
+		if err != nil {
+			m.logSystemf("host readHostStats proc=%s count#HostStatsError=1 err=%q", proc, err)
+			m.metrics.Count("HostStatsError", m.dimensions(), 1)
+			continue
+		}
+
+		gauges, counts := hostMetrics(prev, cur)
+		prev = cur
+
+		dims := m.dimensions()
+		tokens := []string{}
+
+		for name, v := range gauges {
+			m.metrics.Gauge(name, dims, v)
+			tokens = append(tokens, fmt.Sprintf("sample#%s=%.2f", name, v))
+		}
+
+		for name, v := range counts {
+			m.metrics.Count(name, dims, v)
+			tokens = append(tokens, fmt.Sprintf("count#%s=%d", name, int64(v)))
+		}
+
+		sort.Strings(tokens)
+
+		m.logSystemf("host dim#instanceId=%s %s", m.instanceId, strings.Join(tokens, " "))
+	}
+}
+
+// hostMetrics returns gauges and per interval counts
+// Values derived from cumulative counters are only returned when there is a previous sample
+func hostMetrics(prev, cur *hostStats) (map[string]float64, map[string]float64) {
+	gauges := map[string]float64{
+		"host.load1":  cur.load1,
+		"host.load5":  cur.load5,
+		"host.load15": cur.load15,
+	}
+
+	counts := map[string]float64{}
+
+	// MemAvailable is missing before linux 3.14
+	if avail, ok := cur.meminfo["MemAvailable"]; ok && cur.meminfo["MemTotal"] > 0 {
+		total := cur.meminfo["MemTotal"]
+
+		gauges["host.memory.total"] = float64(total)
+		gauges["host.memory.available"] = float64(avail)
+		gauges["host.memory.utilization"] = float64(total-avail) / float64(total) * 100
+	}
+
+	if total := cur.meminfo["SwapTotal"]; total > 0 {
+		used := total - cur.meminfo["SwapFree"]
+
+		gauges["host.swap.used"] = float64(used)
+		gauges["host.swap.utilization"] = float64(used) / float64(total) * 100
+	}
+
+	for name, v := range cur.pressure {
+		gauges["host.pressure."+name] = v
+	}
+
+	if prev == nil {
+		return gauges, counts
+	}
+
+	if cur.cpuTotal > prev.cpuTotal {
+		gauges["host.cpu.steal"] = float64(cur.cpuSteal-prev.cpuSteal) / float64(cur.cpuTotal-prev.cpuTotal) * 100
+	}
+
+	if secs := cur.time.Sub(prev.time).Seconds(); secs > 0 && cur.ctxt >= prev.ctxt {
+		gauges["host.context_switches"] = float64(cur.ctxt-prev.ctxt) / secs
+	}
+
+	// counters reset when an interface goes away so only count increases
+	if cur.netErrors >= prev.netErrors {
+		counts["host.network.errors"] = float64(cur.netErrors - prev.netErrors)
+	}
+
+	if cur.netDrops >= prev.netDrops {
+		counts["host.network.drops"] = float64(cur.netDrops - prev.netDrops)
+	}
+
+	if v, ok := cur.vmstat["pgmajfault"]; ok && v >= prev.vmstat["pgmajfault"] {
+		counts["host.page.major_faults"] = float64(v - prev.vmstat["pgmajfault"])
+	}
+
+	if v, ok := cur.vmstat["oom_kill"]; ok && v >= prev.vmstat["oom_kill"] {
+		counts["host.oom_kills"] = float64(v - prev.vmstat["oom_kill"])
+	}
+
+	return gauges, counts
+}
+
+func readHostStats(proc string) (*hostStats, error) {
+	s := &hostStats{
+		time:     time.Now(),
+		meminfo:  map[string]uint64{},
+		vmstat:   map[string]uint64{},
+		pressure: map[string]float64{},
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(proc, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fmt.Sscanf(string(data), "%f %f %f", &s.load1, &s.load5, &s.load15); err != nil {
+		return nil, fmt.Errorf("invalid loadavg: %s", err)
+	}
+
+	err = eachProcLine(filepath.Join(proc, "meminfo"), func(fields []string) {
+		if len(fields) >= 2 {
+			v, _ := strconv.ParseUint(fields[1], 10, 64)
+			if len(fields) == 3 && fields[2] == "kB" {
+				v *= 1024
+			}
+			s.meminfo[strings.TrimSuffix(fields[0], ":")] = v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachProcLine(filepath.Join(proc, "stat"), func(fields []string) {
+		switch {
+		case len(fields) > 1 && fields[0] == "cpu":
+			for i, f := range fields[1:] {
+				// guest time is already included in user time
+				if i >= 8 {
+					break
+				}
+
+				v, _ := strconv.ParseUint(f, 10, 64)
+				s.cpuTotal += v
+
+				if i == 7 {
+					s.cpuSteal = v
+				}
+			}
+		case len(fields) == 2 && fields[0] == "ctxt":
+			s.ctxt, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachProcLine(filepath.Join(proc, "net/dev"), func(fields []string) {
+		// iface:rx bytes packets errs drop fifo frame compressed multicast tx bytes packets errs drop ...
+		// large counters leave no space after the colon
+		line := strings.Join(fields, " ")
+
+		i := strings.Index(line, ":")
+		if i < 0 || line[0:i] == "lo" {
+			return
+		}
+
+		stats := strings.Fields(line[i+1:])
+		if len(stats) < 12 {
+			return
+		}
+
+		for _, i := range []int{2, 10} {
+			v, _ := strconv.ParseUint(stats[i], 10, 64)
+			s.netErrors += v
+		}
+
+		for _, i := range []int{3, 11} {
+			v, _ := strconv.ParseUint(stats[i], 10, 64)
+			s.netDrops += v
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachProcLine(filepath.Join(proc, "vmstat"), func(fields []string) {
+		if len(fields) == 2 {
+			s.vmstat[fields[0]], _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, resource := range []string{"cpu", "memory", "io"} {
+		eachProcLine(filepath.Join(proc, "pressure", resource), func(fields []string) {
+			if len(fields) > 1 && fields[0] == "some" && strings.HasPrefix(fields[1], "avg10=") {
+				s.pressure[resource], _ = strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+			}
+		})
+	}
+
+	return s, nil
+}
+
+// eachProcLine calls fn with the whitespace separated fields of every line in a /proc file
+func eachProcLine(path string, fn func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		fn(strings.Fields(scanner.Text()))
+	}
+
+	return scanner.Err()
+}
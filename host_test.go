@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeProc(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+}
+
+func TestHostMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proc")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeProc(t, dir, map[string]string{
+		"loadavg": "0.20 0.18 0.12 1/80 11206\n",
+		"meminfo": "MemTotal:        2048 kB\nMemFree:          512 kB\nMemAvailable:    1024 kB\nSwapTotal:       1000 kB\nSwapFree:         750 kB\n",
+		"stat":    "cpu  100 0 100 700 0 0 0 100 0 0\ncpu0 100 0 100 700 0 0 0 100 0 0\nctxt 1000\n",
+		"net/dev": "Inter-|   Receive                                                |  Transmit\n face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n    lo:  100 1 9 9 0 0 0 0 100 1 9 9 0 0 0 0\n  eth0:12345678901 10 1 2 0 0 0 0 500 5 3 4 0 0 0 0\n",
+		"vmstat":  "pgmajfault 10\noom_kill 0\n",
+	})
+
+	prev, err := readHostStats(dir)
+	assert.Nil(t, err)
+
+	gauges, counts := hostMetrics(nil, prev)
+	assert.Equal(t, map[string]float64{
+		"host.load1":              0.2,
+		"host.load5":              0.18,
+		"host.load15":             0.12,
+		"host.memory.total":       2048 * 1024,
+		"host.memory.available":   1024 * 1024,
+		"host.memory.utilization": 50,
+		"host.swap.used":          250 * 1024,
+		"host.swap.utilization":   25,
+	}, gauges)
+	assert.Equal(t, map[string]float64{}, counts)
+
+	writeProc(t, dir, map[string]string{
+		"stat":            "cpu  200 0 200 1400 0 0 0 200 0 0\nctxt 3000\n",
+		"net/dev":         "Inter-|   Receive\n face |bytes\n  eth0:12345678901 10 2 2 0 0 0 0 500 5 3 6 0 0 0 0\n",
+		"vmstat":          "pgmajfault 15\noom_kill 1\n",
+		"pressure/memory": "some avg10=1.50 avg60=0.50 avg300=0.10 total=1234\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n",
+	})
+
+	cur, err := readHostStats(dir)
+	assert.Nil(t, err)
+
+	prev.time = cur.time.Add(-10 * time.Second)
+
+	gauges, counts = hostMetrics(prev, cur)
+	assert.Equal(t, 10.0, gauges["host.cpu.steal"])
+	assert.Equal(t, 200.0, gauges["host.context_switches"])
+	assert.Equal(t, 1.5, gauges["host.pressure.memory"])
+	assert.Equal(t, map[string]float64{
+		"host.network.errors":    1,
+		"host.network.drops":     2,
+		"host.page.major_faults": 5,
+		"host.oom_kills":         1,
+	}, counts)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// failed PutRecords entries are retried with exponential backoff between these bounds
+var KINESIS_RETRY_MIN = 100 * time.Millisecond
+var KINESIS_RETRY_MAX = 30 * time.Second
+
+// how long flushing the kinesis sink waits for buffered lines to be put before the agent stops
+var KINESIS_FLUSH_TIMEOUT = 5 * time.Second
+
+// PutRecords limits
+// See: http://docs.aws.amazon.com/kinesis/latest/APIReference/API_PutRecords.html
+var KINESIS_MAX_RECORDS = 500
+var KINESIS_MAX_RECORD_BYTES = 1024 * 1024
+var KINESIS_MAX_REQUEST_BYTES = 5 * 1024 * 1024
+
+// lines too large for a single record are split, and every record after the first starts with this marker
+var KINESIS_CONTINUATION = []byte("[continued] ")
+
+// kinesisRetry is the retry state of a buffered record that Kinesis has rejected at least once
+type kinesisRetry struct {
+	attempts int
+	failed   time.Time // first failure
+	next     time.Time // not before
+}
+
+// bufferLimits bound the memory used by lines waiting to be put to Kinesis, per stream and in total
+// Policy decides what happens to a new line when a buffer is full:
+// "drop-oldest" discards the oldest buffered line, "drop-newest" discards the new line,
+// and "block" makes the docker log reader wait until streamLogs makes room (agent events drop the oldest line instead)
+type bufferLimits struct {
+	Stream int
+	Total  int
+	Policy string
+}
+
+func (m *Monitor) streamLogs() {
+	Kinesis := kinesis.New(&aws.Config{})
+
+	m.replaySpools()
+
+	for _ = range time.Tick(100 * time.Millisecond) {
+		m.reportDropped()
+
+		for _, stream := range m.streams() {
+			l := m.getLines(stream)
+
+			if l == nil {
+				continue
+			}
+
+			records := &kinesis.PutRecordsInput{
+				Records:    make([]*kinesis.PutRecordsRequestEntry, len(l)),
+				StreamName: aws.String(stream),
+			}
+
+			for i, r := range l {
+				records.Records[i] = &kinesis.PutRecordsRequestEntry{
+					Data:         r.Data,
+					PartitionKey: aws.String(r.Key),
+				}
+			}
+
+			res, err := Kinesis.PutRecords(records)
+			if err != nil {
+				m.logSystemf("container streamLogs stream=%s count#KinesisPutRecordsError=1 err=%q", stream, err)
+				m.metrics.Count("KinesisPutRecordsError", m.dimensions("stream", stream), 1)
+				m.retryLines(stream, l)
+				continue
+			}
+
+			errorCount := 0
+			errorMsg := ""
+
+			for _, r := range res.Records {
+				if r.ErrorCode != nil {
+					errorCount += 1
+					errorMsg = fmt.Sprintf("%s - %s", *r.ErrorCode, *r.ErrorMessage)
+				}
+			}
+
+			failed, delivered := splitFailedRecords(l, res.Records)
+
+			for _, r := range delivered {
+				// truncate the spool only after Kinesis acknowledges the record
+				if err := r.ack(); err != nil {
+					m.logSystemf("container streamLogs stream=%s count#SpoolAckError=1 err=%q", stream, err)
+				}
+			}
+
+			m.metrics.Count("KinesisRecordsSuccesses", m.dimensions("stream", stream), float64(len(res.Records)-errorCount))
+
+			if errorCount > 0 {
+				m.logSystemf("container streamLogs stream=%s count#KinesisRecordsSuccesses=%d count#KinesisRecordsErrors=%d err=%q", stream, len(res.Records)-errorCount, errorCount, errorMsg)
+				m.metrics.Count("KinesisRecordsErrors", m.dimensions("stream", stream), float64(errorCount))
+				m.retryLines(stream, failed)
+			}
+		}
+	}
+}
+
+// splitFailedRecords splits a put batch into records to retry and records Kinesis accepted
+// Once a record fails, later records with the same partition key are retried behind it even if they were
+// accepted, so a container's lines end up in order after a partial failure. Consumers may see those lines twice.
+func splitFailedRecords(records []*kinesisRecord, results []*kinesis.PutRecordsResultEntry) (failed, delivered []*kinesisRecord) {
+	keys := map[string]bool{}
+
+	for i, r := range results {
+		if r.ErrorCode != nil || keys[records[i].Key] {
+			keys[records[i].Key] = true
+			failed = append(failed, records[i])
+			continue
+		}
+
+		delivered = append(delivered, records[i])
+	}
+
+	return failed, delivered
+}
+
+// retryLines puts rejected records back at the front of the stream buffer and backs the stream off
+// Records that have been failing for longer than the max retry age are dead-lettered
+func (m *Monitor) retryLines(stream string, records []*kinesisRecord) {
+	now := time.Now()
+
+	retry := []*kinesisRecord{}
+	attempts := 0
+	dead := 0
+
+	for _, r := range records {
+		if r.retry == nil {
+			r.retry = &kinesisRetry{failed: now}
+		}
+
+		r.retry.attempts += 1
+
+		if now.Sub(r.retry.failed) > m.kinesisRetryAge {
+			dead += 1
+
+			if err := r.ack(); err != nil {
+				m.logSystemf("container retryLines stream=%s count#SpoolAckError=1 err=%q", stream, err)
+			}
+
+			continue
+		}
+
+		if r.retry.attempts > attempts {
+			attempts = r.retry.attempts
+		}
+
+		retry = append(retry, r)
+	}
+
+	if dead > 0 {
+		m.logSystemf("container retryLines stream=%s count#KinesisRecordsDeadLettered=%d", stream, dead)
+		m.metrics.Count("KinesisRecordsDeadLettered", m.dimensions("stream", stream), float64(dead))
+	}
+
+	if len(retry) == 0 {
+		return
+	}
+
+	next := now.Add(kinesisBackoff(attempts))
+
+	for _, r := range retry {
+		r.retry.next = next
+	}
+
+	m.logSystemf("container retryLines stream=%s attempts=%d count#KinesisRecordsRetried=%d", stream, attempts, len(retry))
+	m.metrics.Count("KinesisRecordsRetried", m.dimensions("stream", stream), float64(len(retry)))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// retries go back regardless of the buffer limits, the overflow policy applies to new lines
+	m.pushLines(stream, retry, true)
+}
+
+// kinesisBackoff doubles the delay for every attempt up to KINESIS_RETRY_MAX
+// and picks a random delay in the upper half of that to spread out retries
+func kinesisBackoff(attempts int) time.Duration {
+	d := KINESIS_RETRY_MAX
+
+	if attempts < 20 {
+		if b := KINESIS_RETRY_MIN << uint(attempts-1); b < d {
+			d = b
+		}
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// replaySpools buffers records a previous agent spooled but Kinesis never acknowledged
+func (m *Monitor) replaySpools() {
+	dirs, err := ioutil.ReadDir(m.spoolDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logSystemf("container replaySpools dir=%s count#SpoolError=1 err=%q", m.spoolDir, err)
+		}
+		return
+	}
+
+	for _, d := range dirs {
+		if d.IsDir() {
+			m.getSpool(d.Name())
+		}
+	}
+}
+
+// getSpool opens the spool for a stream on first use and buffers any records it replays
+// If the spool can not be opened the stream is only buffered in memory
+func (m *Monitor) getSpool(stream string) *Spool {
+	if s, ok := m.cachedSpool(stream); ok {
+		return s
+	}
+
+	// opening replays every segment on disk so only hold spoolLock, which keeps two callers
+	// from opening the same stream, and not m.lock which the event loop and buffers need
+	m.spoolLock.Lock()
+	defer m.spoolLock.Unlock()
+
+	if s, ok := m.cachedSpool(stream); ok {
+		return s
+	}
+
+	s, records, err := OpenSpool(filepath.Join(m.spoolDir, stream))
+	if err != nil {
+		m.logSystemf("container getSpool stream=%s count#SpoolError=1 err=%q", stream, err)
+		s, records = nil, nil
+	}
+
+	if len(records) > 0 {
+		m.logSystemf("container getSpool stream=%s count#SpoolReplayed=%d", stream, len(records))
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(records) > 0 {
+		m.pushLines(stream, records, true)
+	}
+
+	m.spools[stream] = s
+
+	return s
+}
+
+func (m *Monitor) cachedSpool(stream string) (*Spool, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.spools[stream]
+	return s, ok
+}
+
+// partitionKey picks the Kinesis partition key for a record from the container or agent KINESIS_PARTITION_KEY env
+// Records with the same key go to the same shard in order, so "container" (the default) and "process"
+// let consumers read each process's lines in the order they were written
+func (m *Monitor) partitionKey(r *LogRecord, env map[string]string) string {
+	strategy := env["KINESIS_PARTITION_KEY"]
+	if strategy == "" {
+		strategy = os.Getenv("KINESIS_PARTITION_KEY")
+	}
+
+	switch strategy {
+	case "process":
+		return fmt.Sprintf("%s/%s", r.App, r.Process)
+	case "random":
+		return strconv.FormatInt(rand.Int63(), 10)
+	default:
+		return r.ContainerID
+	}
+}
+
+// addLine buffers a container log line for a stream using the buffer overflow policy
+func (m *Monitor) addLine(stream, key string, data []byte) {
+	m.bufferLine(stream, key, data, m.bufferLimits.Policy)
+}
+
+// addEvent buffers an agent event for a stream
+// Events are logged from the Docker event loop so they drop the oldest line instead of blocking.
+func (m *Monitor) addEvent(stream, key string, data []byte) {
+	policy := m.bufferLimits.Policy
+	if policy == "block" {
+		policy = "drop-oldest"
+	}
+
+	m.bufferLine(stream, key, data, policy)
+}
+
+// bufferLine splits a line into continuation records if it is over the record size limit and buffers them
+func (m *Monitor) bufferLine(stream, key string, data []byte, policy string) {
+	for _, chunk := range splitLine(key, data) {
+		m.addRecord(stream, key, chunk, policy)
+	}
+}
+
+// splitLine breaks data into chunks that fit into a Kinesis record with the partition key
+func splitLine(key string, data []byte) [][]byte {
+	max := KINESIS_MAX_RECORD_BYTES - len(key)
+
+	if len(data) <= max {
+		return [][]byte{data}
+	}
+
+	chunks := [][]byte{data[0:max]}
+	data = data[max:]
+	max -= len(KINESIS_CONTINUATION)
+
+	for len(data) > 0 {
+		n := max
+		if n > len(data) {
+			n = len(data)
+		}
+
+		chunk := make([]byte, 0, len(KINESIS_CONTINUATION)+n)
+		chunk = append(chunk, KINESIS_CONTINUATION...)
+		chunk = append(chunk, data[0:n]...)
+
+		chunks = append(chunks, chunk)
+		data = data[n:]
+	}
+
+	return chunks
+}
+
+func (m *Monitor) addRecord(stream, key string, data []byte, policy string) {
+	r := &kinesisRecord{Data: data, Key: key}
+
+	if s := m.getSpool(stream); s != nil {
+		sr, err := s.Append(key, data)
+		if err != nil {
+			m.logSystemf("container addLine stream=%s count#SpoolError=1 err=%q", stream, err)
+		} else {
+			r = sr
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for m.bufferFull(stream, r.size()) {
+		switch policy {
+		case "block":
+			m.bufferCond.Wait()
+		case "drop-newest":
+			m.dropLine(stream, r)
+			return
+		default:
+			victim := stream
+			if len(m.lines[stream]) == 0 {
+				victim = m.largestStream()
+			}
+
+			for _, d := range m.shiftLines(victim, 1) {
+				m.dropLine(victim, d)
+			}
+		}
+	}
+
+	m.pushLines(stream, []*kinesisRecord{r}, false)
+}
+
+// getLines returns the next batch of records for a stream
+// A batch is returned when it is full by record count or request size, or when the flush interval has passed
+// Nothing is returned while the stream is backing off from a failed put
+func (m *Monitor) getLines(stream string) []*kinesisRecord {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	lines := m.lines[stream]
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if r := lines[0].retry; r != nil && r.next.After(time.Now()) {
+		return nil
+	}
+
+	nl := 0
+	bytes := 0
+
+	for nl < len(lines) && nl < KINESIS_MAX_RECORDS {
+		if bytes+lines[nl].size() > KINESIS_MAX_REQUEST_BYTES {
+			break
+		}
+
+		bytes += lines[nl].size()
+		nl += 1
+	}
+
+	full := nl < len(lines) || nl == KINESIS_MAX_RECORDS
+
+	if !full && time.Since(m.flushed[stream]) < m.kinesisFlushInterval {
+		return nil
+	}
+
+	m.flushed[stream] = time.Now()
+
+	return m.shiftLines(stream, nl)
+}
+
+// bufferFull reports if a record does not fit in the buffer for a stream
+// An empty buffer always takes a record so a single oversize line can not wedge it
+// Callers must hold m.lock
+func (m *Monitor) bufferFull(stream string, size int) bool {
+	if m.bufferBytes[stream] > 0 && m.bufferBytes[stream]+size > m.bufferLimits.Stream {
+		return true
+	}
+
+	if m.bufferTotal > 0 && m.bufferTotal+size > m.bufferLimits.Total {
+		return true
+	}
+
+	return false
+}
+
+// pushLines buffers records at the back, or the front for retries, of a stream
+// Callers must hold m.lock
+func (m *Monitor) pushLines(stream string, records []*kinesisRecord, front bool) {
+	for _, r := range records {
+		m.bufferBytes[stream] += r.size()
+		m.bufferTotal += r.size()
+	}
+
+	if front {
+		m.lines[stream] = append(records, m.lines[stream]...)
+	} else {
+		m.lines[stream] = append(m.lines[stream], records...)
+	}
+}
+
+// shiftLines removes up to n records from the front of a stream and wakes blocked writers
+// Callers must hold m.lock
+func (m *Monitor) shiftLines(stream string, n int) []*kinesisRecord {
+	if n > len(m.lines[stream]) {
+		n = len(m.lines[stream])
+	}
+
+	ret := make([]*kinesisRecord, n)
+	copy(ret, m.lines[stream])
+	m.lines[stream] = m.lines[stream][n:]
+
+	for _, r := range ret {
+		m.bufferBytes[stream] -= r.size()
+		m.bufferTotal -= r.size()
+	}
+
+	m.bufferCond.Broadcast()
+
+	return ret
+}
+
+// dropLine discards a record that does not fit in the buffer
+// Callers must hold m.lock
+func (m *Monitor) dropLine(stream string, r *kinesisRecord) {
+	m.dropped[stream] += 1
+	m.droppedTotal[stream] += 1
+
+	// a dropped record will never be acknowledged by Kinesis so release it from the spool
+	r.ack()
+}
+
+// largestStream returns the stream with the most buffered bytes
+// Callers must hold m.lock
+func (m *Monitor) largestStream() string {
+	largest := ""
+
+	for stream, bytes := range m.bufferBytes {
+		if largest == "" || bytes > m.bufferBytes[largest] {
+			largest = stream
+		}
+	}
+
+	return largest
+}
+
+// reportDropped logs how many lines the overflow policy discarded since the last report
+// The status API reports droppedTotal which is not reset.
+func (m *Monitor) reportDropped() {
+	m.lock.Lock()
+	dropped := m.dropped
+	if len(dropped) > 0 {
+		m.dropped = make(map[string]int)
+	}
+	m.lock.Unlock()
+
+	for stream, n := range dropped {
+		m.logSystemf("container streamLogs stream=%s policy=%s count#KinesisLinesDropped=%d", stream, m.bufferLimits.Policy, n)
+		m.metrics.Count("KinesisLinesDropped", m.dimensions("stream", stream), float64(n))
+	}
+}
+
+// bufferedLines returns the number of records waiting to be put to every stream
+func (m *Monitor) bufferedLines() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	n := 0
+
+	for _, lines := range m.lines {
+		n += len(lines)
+	}
+
+	return n
+}
+
+func (m *Monitor) streams() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	streams := make([]string, len(m.lines))
+	i := 0
+
+	for key, _ := range m.lines {
+		streams[i] = key
+		i += 1
+	}
+
+	return streams
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/stretchr/testify/assert"
+)
+
+// kinesisMonitor returns a Monitor that buffers a memory only "stream"
+func kinesisMonitor(limits bufferLimits) *Monitor {
+	m := &Monitor{
+		metrics:         NewMetrics(),
+		lines:           make(map[string][]*kinesisRecord),
+		spools:          map[string]*Spool{"stream": nil, "other": nil},
+		kinesisRetryAge: 1 * time.Minute,
+		flushed:         make(map[string]time.Time),
+		bufferLimits:    limits,
+		bufferBytes:     make(map[string]int),
+		dropped:         make(map[string]int),
+		droppedTotal:    make(map[string]int),
+	}
+
+	m.bufferCond = sync.NewCond(&m.lock)
+
+	return m
+}
+
+func TestRetryLines(t *testing.T) {
+	m := kinesisMonitor(bufferLimits{Stream: 1024, Total: 1024})
+
+	stale := &kinesisRecord{Data: []byte("stale"), retry: &kinesisRetry{failed: time.Now().Add(-2 * time.Minute)}}
+	fresh := &kinesisRecord{Data: []byte("fresh")}
+
+	m.addLine("stream", "key", []byte("queued"))
+	m.retryLines("stream", []*kinesisRecord{stale, fresh})
+
+	// the stale record is dead-lettered and the fresh one is retried ahead of queued lines
+	if assert.Equal(t, 2, len(m.lines["stream"])) {
+		assert.Equal(t, []byte("fresh"), m.lines["stream"][0].Data)
+		assert.Equal(t, 1, m.lines["stream"][0].retry.attempts)
+		assert.Equal(t, []byte("queued"), m.lines["stream"][1].Data)
+	}
+
+	// the stream is backing off
+	assert.Nil(t, m.getLines("stream"))
+
+	fresh.retry.next = time.Now()
+
+	assert.Equal(t, 2, len(m.getLines("stream")))
+}
+
+func TestSplitFailedRecords(t *testing.T) {
+	records := []*kinesisRecord{
+		{Key: "web", Data: []byte("1")},
+		{Key: "web", Data: []byte("2")},
+		{Key: "worker", Data: []byte("3")},
+		{Key: "web", Data: []byte("4")},
+	}
+
+	failed, delivered := splitFailedRecords(records, []*kinesis.PutRecordsResultEntry{
+		{ErrorCode: aws.String("ProvisionedThroughputExceededException"), ErrorMessage: aws.String("Rate exceeded")},
+		{},
+		{},
+		{},
+	})
+
+	// accepted lines after a failure with the same key are retried behind it to keep them in order
+	assert.Equal(t, []*kinesisRecord{records[0], records[1], records[3]}, failed)
+	assert.Equal(t, []*kinesisRecord{records[2]}, delivered)
+}
+
+func TestKinesisBackoff(t *testing.T) {
+	for attempts := 1; attempts < 100; attempts++ {
+		d := kinesisBackoff(attempts)
+
+		assert.True(t, d >= KINESIS_RETRY_MIN/2)
+		assert.True(t, d <= KINESIS_RETRY_MAX)
+	}
+}
+
+func TestAddLineDropOldest(t *testing.T) {
+	m := kinesisMonitor(bufferLimits{Stream: 10, Total: 14, Policy: "drop-oldest"})
+
+	m.addLine("stream", "k", []byte("1111"))
+	m.addLine("stream", "k", []byte("2222"))
+	m.addLine("stream", "k", []byte("3333"))
+
+	assert.Equal(t, 2, len(m.lines["stream"]))
+	assert.Equal(t, []byte("2222"), m.lines["stream"][0].Data)
+	assert.Equal(t, 1, m.dropped["stream"])
+
+	// over the total budget the largest stream gives up its oldest line
+	m.addLine("other", "k", []byte("4444"))
+
+	assert.Equal(t, 1, len(m.lines["stream"]))
+	assert.Equal(t, 1, len(m.lines["other"]))
+	assert.Equal(t, 2, m.dropped["stream"])
+	assert.Equal(t, 10, m.bufferTotal)
+}
+
+func TestAddLineDropNewest(t *testing.T) {
+	m := kinesisMonitor(bufferLimits{Stream: 10, Total: 100, Policy: "drop-newest"})
+
+	m.addLine("stream", "k", []byte("1111"))
+	m.addLine("stream", "k", []byte("2222"))
+	m.addLine("stream", "k", []byte("3333"))
+
+	assert.Equal(t, 2, len(m.lines["stream"]))
+	assert.Equal(t, []byte("2222"), m.lines["stream"][1].Data)
+	assert.Equal(t, 1, m.dropped["stream"])
+
+	// reporting resets the interval count but not the total
+	m.reportDropped()
+
+	assert.Equal(t, 0, m.dropped["stream"])
+	assert.Equal(t, 1, m.droppedTotal["stream"])
+}
+
+func TestAddLineBlock(t *testing.T) {
+	m := kinesisMonitor(bufferLimits{Stream: 10, Total: 100, Policy: "block"})
+
+	m.addLine("stream", "k", []byte("1111"))
+	m.addLine("stream", "k", []byte("2222"))
+
+	done := make(chan bool)
+
+	go func() {
+		m.addLine("stream", "k", []byte("3333"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected addLine to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, 2, len(m.getLines("stream")))
+
+	<-done
+
+	assert.Equal(t, 1, len(m.lines["stream"]))
+	assert.Equal(t, 0, m.dropped["stream"])
+}
+
+func TestAddEventDoesNotBlock(t *testing.T) {
+	m := kinesisMonitor(bufferLimits{Stream: 10, Total: 100, Policy: "block"})
+
+	m.addLine("stream", "k", []byte("1111"))
+	m.addLine("stream", "k", []byte("2222"))
+
+	// agent events fall back to dropping the oldest line
+	m.addEvent("stream", "k", []byte("3333"))
+
+	assert.Equal(t, 2, len(m.lines["stream"]))
+	assert.Equal(t, []byte("3333"), m.lines["stream"][1].Data)
+	assert.Equal(t, 1, m.dropped["stream"])
+}
+
+func TestGetLinesBatching(t *testing.T) {
+	defer func(records, bytes int) {
+		KINESIS_MAX_RECORDS = records
+		KINESIS_MAX_REQUEST_BYTES = bytes
+	}(KINESIS_MAX_RECORDS, KINESIS_MAX_REQUEST_BYTES)
+
+	KINESIS_MAX_RECORDS = 3
+	KINESIS_MAX_REQUEST_BYTES = 12
+
+	m := kinesisMonitor(bufferLimits{Stream: 1024, Total: 1024})
+	m.kinesisFlushInterval = 1 * time.Hour
+	m.flushed["stream"] = time.Now()
+
+	m.addLine("stream", "k", []byte("111"))
+	m.addLine("stream", "k", []byte("222"))
+
+	// not full and inside the flush interval
+	assert.Nil(t, m.getLines("stream"))
+
+	m.addLine("stream", "k", []byte("333"))
+	m.addLine("stream", "k", []byte("444"))
+
+	// full by request size
+	assert.Equal(t, 3, len(m.getLines("stream")))
+
+	m.flushed["stream"] = time.Time{}
+
+	// flush interval has passed
+	assert.Equal(t, 1, len(m.getLines("stream")))
+}
+
+func TestSplitLine(t *testing.T) {
+	defer func(bytes int) { KINESIS_MAX_RECORD_BYTES = bytes }(KINESIS_MAX_RECORD_BYTES)
+
+	KINESIS_MAX_RECORD_BYTES = len(KINESIS_CONTINUATION) + 6
+
+	assert.Equal(t, [][]byte{[]byte("short")}, splitLine("k", []byte("short")))
+
+	chunks := splitLine("k", []byte("0123456789abcdefghij"))
+
+	assert.Equal(t, [][]byte{
+		[]byte("0123456789abcdefg"),
+		append(append([]byte{}, KINESIS_CONTINUATION...), []byte("hij")...),
+	}, chunks)
+}
+
+func TestPartitionKey(t *testing.T) {
+	m := kinesisMonitor(bufferLimits{})
+	r := &LogRecord{App: "myapp", Process: "web", ContainerID: "1d11a78279e0"}
+
+	assert.Equal(t, "1d11a78279e0", m.partitionKey(r, map[string]string{}))
+	assert.Equal(t, "myapp/web", m.partitionKey(r, map[string]string{"KINESIS_PARTITION_KEY": "process"}))
+	assert.NotEqual(t, "", m.partitionKey(r, map[string]string{"KINESIS_PARTITION_KEY": "random"}))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// syslog levels of kernel messages
+var kmsgLevels = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// KmsgRecord is a kernel message read from /dev/kmsg
+// priority,sequence,timestamp,flags;message
+type KmsgRecord struct {
+	Level    int
+	Facility int
+	Seq      uint64
+	Uptime   time.Duration // since boot
+	Message  string
+}
+
+// ParseKmsgRecord parses a single /dev/kmsg read
+// Continuation lines with device properties (" SUBSYSTEM=...") are dropped
+func ParseKmsgRecord(data []byte) (*KmsgRecord, error) {
+	s := strings.SplitN(string(data), "\n", 2)[0]
+
+	parts := strings.SplitN(s, ";", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid kmsg record: %q", s)
+	}
+
+	fields := strings.Split(parts[0], ",")
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid kmsg record: %q", s)
+	}
+
+	prio, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kmsg priority: %q", fields[0])
+	}
+
+	seq, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kmsg sequence: %q", fields[1])
+	}
+
+	usec, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kmsg timestamp: %q", fields[2])
+	}
+
+	return &KmsgRecord{
+		Level:    prio & 7,
+		Facility: prio >> 3,
+		Seq:      seq,
+		Uptime:   time.Duration(usec) * time.Microsecond,
+		Message:  parts[1],
+	}, nil
+}
+
+func (r *KmsgRecord) LevelName() string {
+	return kmsgLevels[r.Level]
+}
+
+// Line formats the record like dmesg, i.e. [   12.345678] EXT4-fs (xvda1): Remounting filesystem read-only
+func (r *KmsgRecord) Line() string {
+	return fmt.Sprintf("[%12.6f] %s", r.Uptime.Seconds(), r.Message)
+}
+
+// kmsgState is the high-water mark of processed kernel messages for a boot, which start over on reboot
+// It is the /dev/kmsg sequence number, or the dmesg timestamp in microseconds when polling dmesg.
+type kmsgState struct {
+	path   string
+	bootId string
+	seq    uint64
+	saved  time.Time
+}
+
+func loadKmsgState(path, bootId string) *kmsgState {
+	s := &kmsgState{path: path, bootId: bootId}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s
+	}
+
+	var id string
+	var seq uint64
+
+	if _, err := fmt.Sscanf(string(data), "%s %d", &id, &seq); err == nil && id == bootId {
+		s.seq = seq
+	}
+
+	return s
+}
+
+// save writes the state atomically at most once per CHECKPOINT_INTERVAL unless forced
+func (s *kmsgState) save(force bool) error {
+	if !force && time.Since(s.saved) < CHECKPOINT_INTERVAL {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%s %d\n", s.bootId, s.seq)), 0644); err != nil {
+		return err
+	}
+
+	s.saved = time.Now()
+
+	return os.Rename(tmp, s.path)
+}
+
+// followKmsg reads new kernel messages from /dev/kmsg (KMSG_PATH), forwards them to the system log group
+// and checks them against the dmesg rules. The last processed sequence number is kept in KMSG_STATE_FILE
+// so messages are only acted on once, even across agent restarts.
+// It returns an error if /dev/kmsg can not be read so the caller can fall back to polling dmesg.
+func (m *Monitor) followKmsg(rules []*DmesgRule) error {
+	path := os.Getenv("KMSG_PATH")
+	if path == "" {
+		path = "/dev/kmsg"
+	}
+
+	statePath := kmsgStatePath()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	state := loadKmsgState(statePath, bootId())
+
+	m.logSystemf("dmesg followKmsg path=%s seq=%d", path, state.seq)
+
+	buf := make([]byte, 8192)
+	drained := false
+	oom := &OOMParser{}
+
+	for {
+		n, err := f.Read(buf)
+
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+
+		switch {
+		case err == syscall.EPIPE:
+			// the ring buffer wrapped and overwrote messages we had not read yet
+			m.logSystemf("dmesg followKmsg count#KmsgOverrun=1")
+			m.metrics.Count("KmsgOverrun", m.dimensions(), 1)
+			continue
+		case err != nil:
+			return err
+		}
+
+		r, err := ParseKmsgRecord(buf[0:n])
+		if err != nil {
+			m.logSystemf("dmesg followKmsg count#KmsgParseError=1 err=%q", err)
+			continue
+		}
+
+		if r.Seq <= state.seq && state.seq > 0 {
+			continue
+		}
+
+		state.seq = r.Seq
+
+		m.logSystemf("kernel seq=%d level=%s %s", r.Seq, r.LevelName(), r.Message)
+
+		if k, ok := oom.Feed(r.Message); ok {
+			m.handleKernelOOM(k)
+		}
+
+		rule, ok := matchDmesgRule(rules, r.Message)
+
+		if ok {
+			drained = m.handleDmesgRule(rule, r.Line(), drained)
+		}
+
+		// always persist a matched message so its action is not taken again after a restart
+		if err := state.save(ok); err != nil {
+			m.logSystemf("dmesg followKmsg path=%s count#KmsgStateError=1 err=%q", statePath, err)
+		}
+	}
+}
+
+// kmsgStatePath is where the high-water mark of /dev/kmsg is kept, the dmesg fallback uses the same path with a .dmesg suffix
+func kmsgStatePath() string {
+	if path := os.Getenv("KMSG_STATE_FILE"); path != "" {
+		return path
+	}
+
+	return "/mnt/host_root/var/lib/convox-agent/kmsg"
+}
+
+func bootId() string {
+	id, _ := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(id))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKmsgRecord(t *testing.T) {
+	r, err := ParseKmsgRecord([]byte("3,1234,12345678,-;EXT4-fs (xvda1): Remounting filesystem read-only\n SUBSYSTEM=block\n DEVICE=b202:1\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, r.Level)
+	assert.Equal(t, "err", r.LevelName())
+	assert.Equal(t, 0, r.Facility)
+	assert.Equal(t, uint64(1234), r.Seq)
+	assert.Equal(t, 12345678*time.Microsecond, r.Uptime)
+	assert.Equal(t, "EXT4-fs (xvda1): Remounting filesystem read-only", r.Message)
+	assert.Equal(t, "[   12.345678] EXT4-fs (xvda1): Remounting filesystem read-only", r.Line())
+
+	_, err = ParseKmsgRecord([]byte("garbage"))
+	assert.EqualError(t, err, `invalid kmsg record: "garbage"`)
+}
+
+func TestKmsgState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kmsg")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kmsg")
+
+	s := loadKmsgState(path, "boot-1")
+	assert.Equal(t, uint64(0), s.seq)
+
+	s.seq = 1234
+	assert.Nil(t, s.save(true))
+
+	assert.Equal(t, uint64(1234), loadKmsgState(path, "boot-1").seq)
+
+	// sequence numbers start over after a reboot
+	assert.Equal(t, uint64(0), loadKmsgState(path, "boot-2").seq)
+}
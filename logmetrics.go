@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var logMetricName = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// logMetricDimensions are added to every log metric and can not be named groups
+var logMetricDimensions = []string{"instanceId", "app", "process"}
+
+// CloudWatch rejects datums with more dimensions than this
+const CLOUDWATCH_MAX_DIMENSIONS = 10
+
+// LogMetric turns matching log lines into a metric
+// Rules are declared with container labels:
+//
+// convox.metric.<name>=count:<regex>    count lines matching the regex
+// convox.metric.<name>=sample:<regex>   sample the value of the (?P<value>...) group
+//
+// Any other named groups in the regex become dimensions of the metric, i.e.
+// convox.metric.requests=count:status=(?P<status>\d{3})
+// Groups that match nothing are left out of the dimensions.
+type LogMetric struct {
+	Name string
+	Type string
+	re   *regexp.Regexp
+}
+
+// LogMetricPoint is a value extracted from a single line
+type LogMetricPoint struct {
+	Name       string
+	Type       string
+	Value      float64
+	Dimensions map[string]string
+}
+
+// NewLogMetrics returns the rules declared in container labels, sorted by name
+func NewLogMetrics(labels map[string]string) ([]*LogMetric, error) {
+	metrics := []*LogMetric{}
+
+	for k, v := range labels {
+		if !strings.HasPrefix(k, "convox.metric.") {
+			continue
+		}
+
+		name := strings.TrimPrefix(k, "convox.metric.")
+
+		if !logMetricName.MatchString(name) {
+			return nil, fmt.Errorf("invalid metric name: %s", name)
+		}
+
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid metric %s: expected <type>:<regex>", name)
+		}
+
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric %s: %s", name, err)
+		}
+
+		switch parts[0] {
+		case "count":
+		case "sample":
+			if !hasSubexp(re, "value") {
+				return nil, fmt.Errorf("invalid metric %s: sample needs a (?P<value>...) group", name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid metric %s: unknown type %s", name, parts[0])
+		}
+
+		if err := checkLogMetricGroups(re); err != nil {
+			return nil, fmt.Errorf("invalid metric %s: %s", name, err)
+		}
+
+		metrics = append(metrics, &LogMetric{Name: name, Type: parts[0], re: re})
+	}
+
+	sort.Sort(logMetricsByName(metrics))
+
+	return metrics, nil
+}
+
+// Eval returns a point if the line matches the rule
+func (lm *LogMetric) Eval(line string) (*LogMetricPoint, bool) {
+	match := lm.re.FindStringSubmatch(line)
+	if match == nil {
+		return nil, false
+	}
+
+	p := &LogMetricPoint{
+		Name:       lm.Name,
+		Type:       lm.Type,
+		Value:      1,
+		Dimensions: map[string]string{},
+	}
+
+	for i, group := range lm.re.SubexpNames() {
+		switch group {
+		case "":
+		case "value":
+			v, err := strconv.ParseFloat(match[i], 64)
+			if err != nil {
+				return nil, false
+			}
+			p.Value = v
+		default:
+			if match[i] != "" {
+				p.Dimensions[group] = match[i]
+			}
+		}
+	}
+
+	return p, true
+}
+
+// evalLogMetrics records metrics for a container line that matches any of its rules
+// counts become counters and samples histograms, with app and process dimensions
+func (m *Monitor) evalLogMetrics(id string, env map[string]string, line string) {
+	rules, ok := m.getLogMetrics(id)
+	if !ok {
+		return
+	}
+
+	for _, rule := range rules {
+		p, ok := rule.Eval(line)
+		if !ok {
+			continue
+		}
+
+		dims := m.dimensions("app", appName(env), "process", env["PROCESS"])
+
+		for k, v := range p.Dimensions {
+			dims[k] = v
+		}
+
+		switch p.Type {
+		case "count":
+			m.metrics.Count(p.Name, dims, p.Value)
+		case "sample":
+			m.metrics.Observe(p.Name, dims, p.Value)
+		}
+	}
+}
+
+func (m *Monitor) getLogMetrics(id string) ([]*LogMetric, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	lm, ok := m.logMetrics[id]
+	return lm, ok && len(lm) > 0
+}
+
+func (m *Monitor) setLogMetrics(id string, lm []*LogMetric) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.logMetrics[id] = lm
+}
+
+// checkLogMetricGroups makes sure the named groups of a rule are valid CloudWatch dimensions
+func checkLogMetricGroups(re *regexp.Regexp) error {
+	dims := len(logMetricDimensions)
+
+	for _, group := range re.SubexpNames() {
+		if group == "" || group == "value" {
+			continue
+		}
+
+		for _, d := range logMetricDimensions {
+			if group == d {
+				return fmt.Errorf("group %s is a reserved dimension", group)
+			}
+		}
+
+		dims += 1
+	}
+
+	if dims > CLOUDWATCH_MAX_DIMENSIONS {
+		return fmt.Errorf("more than %d dimensions", CLOUDWATCH_MAX_DIMENSIONS)
+	}
+
+	return nil
+}
+
+func hasSubexp(re *regexp.Regexp, name string) bool {
+	for _, n := range re.SubexpNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type logMetricsByName []*LogMetric
+
+func (a logMetricsByName) Len() int           { return len(a) }
+func (a logMetricsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a logMetricsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
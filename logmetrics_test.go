@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogMetrics(t *testing.T) {
+	metrics, err := NewLogMetrics(map[string]string{
+		"convox.metric.requests": `count:status=(?P<status>\d{3})`,
+		"convox.metric.latency":  `sample:duration=(?P<value>[\d.]+)ms`,
+		"com.example.other":      "ignored",
+	})
+	assert.Nil(t, err)
+
+	if assert.Equal(t, 2, len(metrics)) {
+		assert.Equal(t, "latency", metrics[0].Name)
+		assert.Equal(t, "requests", metrics[1].Name)
+	}
+
+	p, ok := metrics[0].Eval("GET / status=200 duration=12.5ms")
+	assert.True(t, ok)
+	assert.Equal(t, &LogMetricPoint{Name: "latency", Type: "sample", Value: 12.5, Dimensions: map[string]string{}}, p)
+
+	p, ok = metrics[1].Eval("GET / status=503 duration=1ms")
+	assert.True(t, ok)
+	assert.Equal(t, &LogMetricPoint{Name: "requests", Type: "count", Value: 1, Dimensions: map[string]string{"status": "503"}}, p)
+
+	_, ok = metrics[1].Eval("Listening on 3000")
+	assert.False(t, ok)
+
+	// optional groups that match nothing are not dimensions
+	metrics, err = NewLogMetrics(map[string]string{"convox.metric.requests": `count:GET (?P<path>/\S*)( status=(?P<status>\d{3}))?`})
+	assert.Nil(t, err)
+
+	p, ok = metrics[0].Eval("GET /health")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"path": "/health"}, p.Dimensions)
+}
+
+func TestLogMetricsConfig(t *testing.T) {
+	_, err := NewLogMetrics(map[string]string{"convox.metric.latency": `sample:duration=(\d+)`})
+	assert.NotNil(t, err)
+
+	_, err = NewLogMetrics(map[string]string{"convox.metric.errors": `gauge:error`})
+	assert.NotNil(t, err)
+
+	_, err = NewLogMetrics(map[string]string{"convox.metric.bad name": `count:error`})
+	assert.NotNil(t, err)
+
+	_, err = NewLogMetrics(map[string]string{"convox.metric.errors": `count:(?P<app>\w+) error`})
+	assert.EqualError(t, err, "invalid metric errors: group app is a reserved dimension")
+
+	_, err = NewLogMetrics(map[string]string{"convox.metric.errors": `count:(?P<a>.)(?P<b>.)(?P<c>.)(?P<d>.)(?P<e>.)(?P<f>.)(?P<g>.)(?P<h>.)`})
+	assert.EqualError(t, err, "invalid metric errors: more than 10 dimensions")
+}
@@ -1,19 +1,39 @@
 package main
 
-import "time"
+import (
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
 
 var MONITOR_INTERVAL = 5 * time.Minute
 
 func main() {
+	rand.Seed(time.Now().UnixNano())
+
 	monitor := NewMonitor()
 
+	monitor.RegisterHealthCheck(NewHealthCheck("disk", MONITOR_INTERVAL, monitor.checkDisk))
+	monitor.RegisterHealthCheck(NewHealthCheck("docker", MONITOR_INTERVAL, monitor.checkDocker))
+	monitor.RegisterHealthCheck(NewHealthCheck("dmesg", MONITOR_INTERVAL, monitor.checkDmesg))
+
 	go monitor.Containers()
-	go monitor.Disk()
-	go monitor.Docker()
+	go monitor.HealthChecks()
+	go monitor.Host()
 	go monitor.Dmesg()
 	go monitor.Spot()
+	go monitor.Stats()
+	go monitor.PublishMetrics()
+	go monitor.ServeMetrics()
+	go monitor.ServeStatus()
+
+	// flush logs and save checkpoints when ECS or an upgrade stops the agent
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	<-sig
 
-	for {
-		time.Sleep(60 * time.Second)
-	}
+	monitor.Shutdown()
 }
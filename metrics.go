@@ -0,0 +1,280 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+var METRICS_INTERVAL = 1 * time.Minute
+
+// CloudWatch PutMetricData accepts at most 20 datums per request
+var CLOUDWATCH_MAX_DATUMS = 20
+
+// Dimensions qualify a metric, i.e. {"instanceId": "i-553ffcd2", "app": "myapp"}
+type Dimensions map[string]string
+
+// Metrics is an in-process registry of agent metrics
+// Counters and gauges keep their current value, and every series also aggregates the values
+// recorded since the last Flush so they can be published once per interval.
+type Metrics struct {
+	lock     sync.Mutex
+	series   map[string]*MetricSeries
+	emitters []MetricEmitter
+}
+
+// MetricEmitter is sent every value as it is recorded, i.e. to a StatsD daemon
+type MetricEmitter interface {
+	Emit(kind, name string, dims Dimensions, v float64)
+}
+
+type MetricSeries struct {
+	Name       string
+	Kind       string // counter, gauge or histogram
+	Dimensions Dimensions
+
+	// Value is the counter total or the last gauge value
+	Value float64
+
+	// statistics since the last Flush
+	Count float64
+	Sum   float64
+	Min   float64
+	Max   float64
+
+	// statistics since the agent started
+	TotalCount float64
+	TotalSum   float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{series: map[string]*MetricSeries{}}
+}
+
+// AddEmitter sends every value recorded from now on to e
+func (ms *Metrics) AddEmitter(e MetricEmitter) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.emitters = append(ms.emitters, e)
+}
+
+// Count adds to a counter
+func (ms *Metrics) Count(name string, dims Dimensions, v float64) {
+	ms.record("counter", name, dims, v)
+}
+
+// Gauge sets the current value of a gauge
+func (ms *Metrics) Gauge(name string, dims Dimensions, v float64) {
+	ms.record("gauge", name, dims, v)
+}
+
+// Observe records a sample in a histogram
+func (ms *Metrics) Observe(name string, dims Dimensions, v float64) {
+	ms.record("histogram", name, dims, v)
+}
+
+func (ms *Metrics) record(kind, name string, dims Dimensions, v float64) {
+	ms.lock.Lock()
+	emitters := ms.emitters
+	ms.aggregate(kind, name, dims, v)
+	ms.lock.Unlock()
+
+	for _, e := range emitters {
+		e.Emit(kind, name, dims, v)
+	}
+}
+
+func (ms *Metrics) aggregate(kind, name string, dims Dimensions, v float64) {
+	key := metricKey(name, dims)
+
+	s, ok := ms.series[key]
+	if !ok {
+		s = &MetricSeries{Name: name, Kind: kind, Dimensions: dims}
+		ms.series[key] = s
+	}
+
+	switch kind {
+	case "counter":
+		s.Value += v
+	case "gauge":
+		s.Value = v
+	}
+
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+
+	s.Count += 1
+	s.Sum += v
+	s.TotalCount += 1
+	s.TotalSum += v
+}
+
+// Flush returns the series recorded since the last Flush and resets their statistics
+func (ms *Metrics) Flush() []MetricSeries {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	flushed := []MetricSeries{}
+
+	for _, s := range ms.series {
+		if s.Count == 0 {
+			continue
+		}
+
+		flushed = append(flushed, *s)
+
+		s.Count, s.Sum, s.Min, s.Max = 0, 0, 0, 0
+	}
+
+	return flushed
+}
+
+// Remove forgets a series, i.e. the gauges of a process that is no longer running
+func (ms *Metrics) Remove(name string, dims Dimensions) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.series, metricKey(name, dims))
+}
+
+// Snapshot returns every series sorted by name and dimensions without resetting anything
+func (ms *Metrics) Snapshot() []MetricSeries {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	keys := []string{}
+	for k := range ms.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	series := []MetricSeries{}
+	for _, k := range keys {
+		series = append(series, *ms.series[k])
+	}
+
+	return series
+}
+
+// metricKey identifies a series by name and sorted dimensions
+func metricKey(name string, dims Dimensions) string {
+	parts := []string{name}
+
+	for _, k := range sortedKeys(dims) {
+		parts = append(parts, k+"="+dims[k])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys(dims Dimensions) []string {
+	keys := []string{}
+	for k := range dims {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dimensions returns the instanceId dimension plus pairs of keys and values
+func (m *Monitor) dimensions(kv ...string) Dimensions {
+	dims := Dimensions{"instanceId": m.instanceId}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			dims[kv[i]] = kv[i+1]
+		}
+	}
+
+	return dims
+}
+
+// PublishMetrics puts the metrics recorded every interval to CloudWatch
+func (m *Monitor) PublishMetrics() {
+	m.logSystemf("metrics at=start")
+
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = "Convox"
+	}
+
+	CloudWatch := cloudwatch.New(&aws.Config{})
+
+	for _ = range time.Tick(METRICS_INTERVAL) {
+		data := cloudwatchMetricData(m.metrics.Flush(), time.Now())
+
+		if os.Getenv("DEVELOPMENT") == "true" {
+			continue
+		}
+
+		for len(data) > 0 {
+			n := len(data)
+			if n > CLOUDWATCH_MAX_DATUMS {
+				n = CLOUDWATCH_MAX_DATUMS
+			}
+
+			_, err := CloudWatch.PutMetricData(&cloudwatch.PutMetricDataInput{
+				MetricData: data[0:n],
+				Namespace:  aws.String(namespace),
+			})
+			if err != nil {
+				m.logSystemf("metrics PutMetricData namespace=%s count#CloudWatchPutMetricDataError=1 err=%q", namespace, err)
+				m.metrics.Count("CloudWatchPutMetricDataError", m.dimensions(), 1)
+			}
+
+			data = data[n:]
+		}
+	}
+}
+
+// cloudwatchMetricData converts series to datums
+// counters are published as the count for the interval, gauges and histograms as a statistic set
+func cloudwatchMetricData(series []MetricSeries, ts time.Time) []*cloudwatch.MetricDatum {
+	data := []*cloudwatch.MetricDatum{}
+
+	for _, s := range series {
+		d := &cloudwatch.MetricDatum{
+			MetricName: aws.String(s.Name),
+			Timestamp:  aws.Time(ts),
+		}
+
+		for _, k := range sortedKeys(s.Dimensions) {
+			// CloudWatch rejects the whole request for an empty dimension value
+			if s.Dimensions[k] == "" {
+				continue
+			}
+
+			d.Dimensions = append(d.Dimensions, &cloudwatch.Dimension{
+				Name:  aws.String(k),
+				Value: aws.String(s.Dimensions[k]),
+			})
+		}
+
+		if s.Kind == "counter" {
+			d.Unit = aws.String(cloudwatch.StandardUnitCount)
+			d.Value = aws.Float64(s.Sum)
+		} else {
+			d.StatisticValues = &cloudwatch.StatisticSet{
+				Maximum:     aws.Float64(s.Max),
+				Minimum:     aws.Float64(s.Min),
+				SampleCount: aws.Float64(s.Count),
+				Sum:         aws.Float64(s.Sum),
+			}
+		}
+
+		data = append(data, d)
+	}
+
+	return data
+}
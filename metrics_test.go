@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsFlush(t *testing.T) {
+	ms := NewMetrics()
+	dims := Dimensions{"instanceId": "i-553ffcd2", "app": "myapp"}
+
+	ms.Count("LinesRedacted", dims, 1)
+	ms.Count("LinesRedacted", Dimensions{"app": "myapp", "instanceId": "i-553ffcd2"}, 2)
+	ms.Gauge("disk.utilization", dims, 40)
+	ms.Gauge("disk.utilization", dims, 50)
+	ms.Observe("latency", dims, 12)
+	ms.Observe("latency", dims, 3)
+
+	series := map[string]MetricSeries{}
+	for _, s := range ms.Flush() {
+		series[s.Name] = s
+	}
+
+	assert.Equal(t, 3, len(series))
+	assert.Equal(t, 3.0, series["LinesRedacted"].Value)
+	assert.Equal(t, 3.0, series["LinesRedacted"].Sum)
+	assert.Equal(t, 50.0, series["disk.utilization"].Value)
+	assert.Equal(t, 40.0, series["disk.utilization"].Min)
+	assert.Equal(t, 2.0, series["latency"].Count)
+	assert.Equal(t, 3.0, series["latency"].Min)
+	assert.Equal(t, 12.0, series["latency"].Max)
+
+	// nothing new was recorded this interval
+	assert.Equal(t, 0, len(ms.Flush()))
+}
+
+func TestCloudwatchMetricData(t *testing.T) {
+	ts := time.Date(2016, 4, 20, 17, 59, 27, 0, time.UTC)
+
+	data := cloudwatchMetricData([]MetricSeries{
+		{Name: "LinesRedacted", Kind: "counter", Dimensions: Dimensions{"instanceId": "i-553ffcd2", "app": "myapp"}, Value: 10, Count: 2, Sum: 3, Min: 1, Max: 2},
+		{Name: "latency", Kind: "histogram", Dimensions: Dimensions{"instanceId": "i-553ffcd2"}, Count: 2, Sum: 15, Min: 3, Max: 12},
+	}, ts)
+
+	assert.Equal(t, 2, len(data))
+
+	assert.Equal(t, "LinesRedacted", *data[0].MetricName)
+	assert.Equal(t, "app", *data[0].Dimensions[0].Name)
+	assert.Equal(t, "instanceId", *data[0].Dimensions[1].Name)
+	assert.Equal(t, cloudwatch.StandardUnitCount, *data[0].Unit)
+	assert.Equal(t, 3.0, *data[0].Value)
+
+	assert.Nil(t, data[1].Value)
+	assert.Equal(t, 2.0, *data[1].StatisticValues.SampleCount)
+	assert.Equal(t, 15.0, *data[1].StatisticValues.Sum)
+	assert.Equal(t, 3.0, *data[1].StatisticValues.Minimum)
+	assert.Equal(t, 12.0, *data[1].StatisticValues.Maximum)
+}
+
+func TestAWSLogsErrors(t *testing.T) {
+	group, n, ok := awslogsErrors(`awslogs publishBatch putLogEvents group=myapp-LogGroup-1KIJO8SS9F3Q9 stream=web/1d11a78279e0 dim#group=myapp-LogGroup-1KIJO8SS9F3Q9 count#CloudWatchEventsErrors=12 err="ThrottlingException: Rate exceeded"`)
+	assert.True(t, ok)
+	assert.Equal(t, "myapp-LogGroup-1KIJO8SS9F3Q9", group)
+	assert.Equal(t, 12, n)
+
+	_, _, ok = awslogsErrors(`awslogs create stream=web/1d11a78279e0`)
+	assert.False(t, ok)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,7 +20,8 @@ import (
 )
 
 type Monitor struct {
-	client *docker.Client
+	client  *docker.Client
+	started time.Time
 
 	envs map[string]map[string]string
 
@@ -39,9 +41,39 @@ type Monitor struct {
 	kernelVersion       string
 	convoxVersion       string
 
+	metrics    *Metrics
+	crashLoops *CrashLoops
+	health     *Health
+
 	lock    sync.Mutex
-	lines   map[string][][]byte
+	lines   map[string][]*kinesisRecord
 	loggers map[string]logger.Logger
+	sinks   []LogSink
+
+	limiters   map[string]*RateLimiter
+	logMetrics map[string][]*LogMetric
+	redactors  map[string]*Redactor
+
+	ooms map[string]time.Time
+
+	dmesgFailure string
+
+	spoolDir  string
+	spools    map[string]*Spool
+	spoolLock sync.Mutex
+
+	checkpoints *Checkpoints
+
+	kinesisFlushInterval time.Duration
+	kinesisRetryAge      time.Duration
+	flushed              map[string]time.Time
+
+	bufferLimits bufferLimits
+	bufferBytes  map[string]int
+	bufferTotal  int
+	bufferCond   *sync.Cond
+	dropped      map[string]int
+	droppedTotal map[string]int
 }
 
 func NewMonitor() *Monitor {
@@ -63,7 +95,8 @@ func NewMonitor() *Monitor {
 	}
 
 	m := &Monitor{
-		client: client,
+		client:  client,
+		started: time.Now(),
 
 		envs: make(map[string]map[string]string),
 
@@ -82,10 +115,54 @@ func NewMonitor() *Monitor {
 		ecsAgentImage:       img,
 		kernelVersion:       info.Get("KernelVersion"),
 
-		lines:   make(map[string][][]byte),
+		metrics:    NewMetrics(),
+		crashLoops: NewCrashLoops(envDuration("CRASH_LOOP_WINDOW", 5*time.Minute), envInt("CRASH_LOOP_THRESHOLD", 5)),
+		health:     NewHealth(),
+
+		lines:   make(map[string][]*kinesisRecord),
 		loggers: make(map[string]logger.Logger),
+
+		limiters:   make(map[string]*RateLimiter),
+		logMetrics: make(map[string][]*LogMetric),
+		redactors:  make(map[string]*Redactor),
+
+		ooms: make(map[string]time.Time),
+
+		spoolDir: "/mnt/host_root/var/lib/convox-agent/spool",
+		spools:   make(map[string]*Spool),
+
+		checkpoints: NewCheckpoints("/mnt/host_root/var/lib/convox-agent/checkpoints.json"),
+
+		kinesisFlushInterval: envDuration("KINESIS_FLUSH_INTERVAL", 1*time.Second),
+		kinesisRetryAge:      envDuration("KINESIS_RETRY_AGE", 1*time.Hour),
+		flushed:              make(map[string]time.Time),
+
+		bufferLimits: bufferLimits{
+			Stream: envInt("KINESIS_STREAM_BUFFER_BYTES", 16*1024*1024),
+			Total:  envInt("KINESIS_BUFFER_BYTES", 64*1024*1024),
+			Policy: os.Getenv("KINESIS_BUFFER_POLICY"),
+		},
+		bufferBytes:  make(map[string]int),
+		dropped:      make(map[string]int),
+		droppedTotal: make(map[string]int),
+	}
+
+	m.bufferCond = sync.NewCond(&m.lock)
+
+	if m.bufferLimits.Policy == "" {
+		m.bufferLimits.Policy = "drop-oldest"
 	}
 
+	if os.Getenv("SPOOL_DIR") != "" {
+		m.spoolDir = os.Getenv("SPOOL_DIR")
+	}
+
+	if os.Getenv("CHECKPOINT_FILE") != "" {
+		m.checkpoints = NewCheckpoints(os.Getenv("CHECKPOINT_FILE"))
+	}
+
+	m.sinks = m.startSinks()
+
 	cfg := ec2metadata.Config{}
 
 	if os.Getenv("EC2_METADATA_ENDPOINT") != "" {
@@ -102,6 +179,17 @@ func NewMonitor() *Monitor {
 		m.region, _ = svc.Region()
 	}
 
+	if addr := os.Getenv("STATSD_ADDR"); addr != "" {
+		tags := Dimensions{"az": m.az, "instanceType": m.instanceType}
+
+		s, err := NewStatsD(addr, os.Getenv("STATSD_DOGSTATSD") != "false", tags)
+		if err != nil {
+			fmt.Printf("NewMonitor NewStatsD addr=%s err=%q\n", addr, err)
+		} else {
+			m.metrics.AddEmitter(s)
+		}
+	}
+
 	fmt.Printf("NewMonitor az=%s instanceId=%s instanceType=%s region=%s agentImage=%s amiId=%s dockerServerVersion=%s ecsAgentImage=%s kernelVersion=%s\n",
 		m.az, m.instanceId, m.instanceType, m.region,
 		m.agentImage, m.amiId, m.dockerServerVersion, m.ecsAgentImage, m.kernelVersion,
@@ -110,26 +198,26 @@ func NewMonitor() *Monitor {
 	return m
 }
 
-// Write event to app CloudWatch Log Group and Kinesis stream
+// Write event to app log sinks (CloudWatch Log Group and Kinesis stream)
 func (m *Monitor) logAppEvent(id, message string) {
-	// append syslog-ish prefix:
-	// agent:0.66/i-553ffcd2 Starting hello-world process 977a93d4d48e
-
-	msg := fmt.Sprintf("agent:%s/%s %s", m.agentVersion, m.instanceId, message)
-
-	ts := time.Now()
-
-	if awslogger, ok := m.loggers[id]; ok {
-		awslogger.Log(&logger.Message{
-			ContainerID: id,
-			Line:        []byte(msg),
-			Timestamp:   ts,
-		})
-	}
+	m.logAppEventFields(id, message, nil)
+}
 
-	if stream, ok := m.envs[id]["KINESIS"]; ok {
-		m.addLine(stream, []byte(fmt.Sprintf("%s %s", ts.Format("2006-01-02 15:04:05"), msg))) // add timestamp to kinesis for legacy purposes
-	}
+// Write event with structured fields to app log sinks
+func (m *Monitor) logAppEventFields(id, message string, fields map[string]interface{}) {
+	env, _ := m.getEnv(id)
+
+	m.forward(&LogRecord{
+		Timestamp:   time.Now(),
+		App:         appName(env),
+		Process:     env["PROCESS"],
+		Release:     env["RELEASE"],
+		ContainerID: id,
+		Format:      env["LOG_FORMAT"],
+		Line:        []byte(message),
+		Event:       true,
+		Fields:      fields,
+	})
 }
 
 // logSystem write event to stdout and convox CloudWatch Log Group, prefixed with an instance id
@@ -199,9 +287,12 @@ func (m *Monitor) ReportError(err error) {
 	rollbar.ErrorWithStackSkip(rollbar.CRIT, err, 1, extraField)
 }
 
-func (m *Monitor) SetUnhealthy(system string, reason error) {
+// SetUnhealthy reports a failed system and marks the instance unhealthy in its AutoScaling group
+// It returns the AutoScaling error so callers can try again.
+func (m *Monitor) SetUnhealthy(system string, reason error) error {
 	metric := ucfirst(system) + "Error" // DockerError or DmesgError
 	m.logSystemf("%s ok=false count#%s err=%q", system, metric, reason)
+	m.metrics.Count(metric, m.dimensions(), 1)
 	m.ReportError(reason)
 
 	AutoScaling := autoscaling.New(&aws.Config{})
@@ -213,18 +304,39 @@ func (m *Monitor) SetUnhealthy(system string, reason error) {
 	})
 	if err != nil {
 		m.logSystemf("monitor AutoScaling.SetInstanceHealth count#AutoScalingSetInstanceHealthError=1 err=%q", err)
+		m.metrics.Count("AutoScalingSetInstanceHealthError", m.dimensions(), 1)
 	} else {
 		// log for humans
 		m.logSystemf("who=\"convox/agent\" what=\"marked instance %s unhealthy\" why=\"%s %s\"", m.instanceId, system, reason)
 	}
 
 	// Dump dmesg to convox log stream and rollbar
-	out, err := exec.Command("dmesg").CombinedOutput()
-	if err != nil {
-		m.ReportError(err)
+	out, derr := exec.Command("dmesg").CombinedOutput()
+	if derr != nil {
+		m.ReportError(derr)
 	} else {
 		m.ReportError(errors.New(string(out)))
 	}
+
+	return err
+}
+
+// envInt returns an integer setting from the environment or the default if it is unset or invalid
+func envInt(name string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// envDuration returns a duration setting like "30s" from the environment or the default if it is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return d
 }
 
 func ucfirst(s string) string {
@@ -4,6 +4,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/convox/rack/api/awsutil"
 	"github.com/docker/docker/daemon/logger"
@@ -121,7 +122,8 @@ func TestNewMonitor(t *testing.T) {
 
 	assert.EqualValues(t,
 		&Monitor{
-			client: monitor.client,
+			client:  monitor.client,
+			started: monitor.started,
 
 			envs: make(map[string]map[string]string),
 
@@ -140,8 +142,38 @@ func TestNewMonitor(t *testing.T) {
 			ecsAgentImage:       "46e05d110968",
 			kernelVersion:       "4.1.13-19.31.amzn1.x86_64",
 
-			lines:   make(map[string][][]byte),
+			metrics:    NewMetrics(),
+			crashLoops: NewCrashLoops(5*time.Minute, 5),
+			health:     NewHealth(),
+
+			lines:   make(map[string][]*kinesisRecord),
 			loggers: make(map[string]logger.Logger),
+			sinks:   monitor.sinks,
+
+			limiters:   make(map[string]*RateLimiter),
+			logMetrics: make(map[string][]*LogMetric),
+			redactors:  make(map[string]*Redactor),
+
+			ooms: make(map[string]time.Time),
+
+			spoolDir: "/mnt/host_root/var/lib/convox-agent/spool",
+			spools:   make(map[string]*Spool),
+
+			checkpoints: NewCheckpoints("/mnt/host_root/var/lib/convox-agent/checkpoints.json"),
+
+			kinesisFlushInterval: 1 * time.Second,
+			kinesisRetryAge:      1 * time.Hour,
+			flushed:              make(map[string]time.Time),
+
+			bufferLimits: bufferLimits{
+				Stream: 16 * 1024 * 1024,
+				Total:  64 * 1024 * 1024,
+				Policy: "drop-oldest",
+			},
+			bufferBytes:  make(map[string]int),
+			bufferCond:   monitor.bufferCond,
+			dropped:      make(map[string]int),
+			droppedTotal: make(map[string]int),
 		},
 		monitor,
 	)
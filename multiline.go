@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// records are flushed when they reach this many lines so a runaway trace can't grow without bound
+var MULTILINE_MAX_LINES = 1000
+
+// Multiline groups continuation lines, like a stack trace, into a single record
+// It is configured with container env:
+//
+// LOG_MULTILINE_START=<regex>   a line matching the regex starts a new record, anything else continues the last one
+// LOG_MULTILINE=indent          a line starting with whitespace continues the last record
+// LOG_MULTILINE_TIMEOUT=1s      a pending record is flushed when no line arrives for this long
+type Multiline struct {
+	start   *regexp.Regexp
+	indent  bool
+	timeout time.Duration
+	flush   func(ts, last time.Time, line string)
+
+	lock  sync.Mutex
+	ts    time.Time
+	last  time.Time
+	lines []string
+	timer *time.Timer
+}
+
+// NewMultiline returns nil if the container env does not ask for multi-line grouping
+// flush gets the timestamp of the first and the last line of each record.
+func NewMultiline(env map[string]string, flush func(ts, last time.Time, line string)) (*Multiline, error) {
+	ml := &Multiline{
+		indent:  env["LOG_MULTILINE"] == "indent",
+		timeout: 1 * time.Second,
+		flush:   flush,
+	}
+
+	if s := env["LOG_MULTILINE_START"]; s != "" {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+
+		ml.start = re
+	}
+
+	if ml.start == nil && !ml.indent {
+		return nil, nil
+	}
+
+	if t := env["LOG_MULTILINE_TIMEOUT"]; t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOG_MULTILINE_TIMEOUT: %s", err)
+		}
+
+		ml.timeout = d
+	}
+
+	return ml, nil
+}
+
+// Add appends a line to the pending record, or flushes the pending record and starts a new one
+func (ml *Multiline) Add(ts time.Time, line string) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	if len(ml.lines) == 0 || !ml.continues(line) || len(ml.lines) >= MULTILINE_MAX_LINES {
+		ml.flushLocked()
+		ml.ts = ts
+	}
+
+	ml.last = ts
+	ml.lines = append(ml.lines, line)
+
+	if ml.timer == nil {
+		ml.timer = time.AfterFunc(ml.timeout, ml.Flush)
+	} else {
+		ml.timer.Reset(ml.timeout)
+	}
+}
+
+// Flush forwards the pending record, if any
+func (ml *Multiline) Flush() {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	ml.flushLocked()
+}
+
+func (ml *Multiline) flushLocked() {
+	if len(ml.lines) == 0 {
+		return
+	}
+
+	ml.flush(ml.ts, ml.last, strings.Join(ml.lines, "\n"))
+	ml.lines = nil
+}
+
+func (ml *Multiline) continues(line string) bool {
+	if ml.start != nil {
+		return !ml.start.MatchString(line)
+	}
+
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultilineStart(t *testing.T) {
+	records := []string{}
+
+	ml, err := NewMultiline(map[string]string{"LOG_MULTILINE_START": `^\d{4}-`}, func(ts, last time.Time, line string) {
+		records = append(records, line)
+	})
+	assert.Nil(t, err)
+
+	ts := time.Now()
+
+	ml.Add(ts, "2016-04-20 error")
+	ml.Add(ts, "java.lang.NullPointerException")
+	ml.Add(ts, "	at Foo.bar(Foo.java:12)")
+	ml.Add(ts, "2016-04-20 ok")
+	ml.Flush()
+
+	assert.Equal(t, []string{
+		"2016-04-20 error\njava.lang.NullPointerException\n	at Foo.bar(Foo.java:12)",
+		"2016-04-20 ok",
+	}, records)
+}
+
+func TestMultilineIndentTimeout(t *testing.T) {
+	records := make(chan string, 10)
+
+	ml, err := NewMultiline(map[string]string{"LOG_MULTILINE": "indent", "LOG_MULTILINE_TIMEOUT": "10ms"}, func(ts, last time.Time, line string) {
+		records <- line
+	})
+	assert.Nil(t, err)
+
+	ml.Add(time.Now(), "NoMethodError: undefined method")
+	ml.Add(time.Now(), "  app/models/user.rb:10")
+
+	select {
+	case r := <-records:
+		assert.Equal(t, "NoMethodError: undefined method\n  app/models/user.rb:10", r)
+	case <-time.After(1 * time.Second):
+		t.Fatal("expected pending record to flush after timeout")
+	}
+}
+
+func TestMultilineDisabled(t *testing.T) {
+	ml, err := NewMultiline(map[string]string{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, ml)
+
+	_, err = NewMultiline(map[string]string{"LOG_MULTILINE_START": "("}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestMultilineLast(t *testing.T) {
+	first := time.Date(2016, 4, 20, 17, 59, 27, 0, time.UTC)
+	last := first.Add(2 * time.Second)
+
+	var ts, through time.Time
+
+	ml, err := NewMultiline(map[string]string{"LOG_MULTILINE": "indent"}, func(t1, t2 time.Time, line string) {
+		ts, through = t1, t2
+	})
+	assert.Nil(t, err)
+
+	ml.Add(first, "NoMethodError: undefined method")
+	ml.Add(first.Add(1*time.Second), "  app/models/user.rb:10")
+	ml.Add(last, "  app/controllers/users_controller.rb:5")
+	ml.Flush()
+
+	assert.Equal(t, first, ts)
+	assert.Equal(t, last, through)
+}
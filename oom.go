@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// the kernel and docker both report an OOM kill, only tell the app once within this window
+var OOM_DEDUPE_WINDOW = 1 * time.Minute
+
+var (
+	// Task in /docker/<id> killed as a result of limit of /docker/<id> (before linux 4.19)
+	oomTaskIn = regexp.MustCompile(`Task in (\S+) killed as a result of limit`)
+
+	// oom-kill:constraint=CONSTRAINT_MEMCG,...,task_memcg=/ecs/<task>/<id>,task=java,pid=1234,uid=0 (linux 4.19+)
+	oomKillMemcg = regexp.MustCompile(`oom-kill:.*task_memcg=([^,\s]+)`)
+
+	// Killed process 1234 (java) total-vm:2340000kB, anon-rss:520000kB, file-rss:1200kB, shmem-rss:0kB
+	oomKilled = regexp.MustCompile(`Killed process (\d+) \(([^)]*)\).*anon-rss:(\d+)kB, file-rss:(\d+)kB(?:, shmem-rss:(\d+)kB)?`)
+
+	// a container ID is the last 64 hex characters of a docker or ecs cgroup path
+	oomContainerId = regexp.MustCompile(`([0-9a-f]{64})$`)
+)
+
+// OOMKill is a process the kernel OOM killer stopped
+type OOMKill struct {
+	Pid         int
+	Command     string
+	Cgroup      string
+	ContainerID string
+	RSS         uint64 // bytes
+}
+
+// OOMParser follows kernel messages and returns an OOMKill once a report is complete
+// The memory cgroup of the victim is logged a few lines before the "Killed process" line.
+type OOMParser struct {
+	cgroup string
+}
+
+// Feed parses the next kernel message
+func (p *OOMParser) Feed(msg string) (*OOMKill, bool) {
+	if m := oomTaskIn.FindStringSubmatch(msg); m != nil {
+		p.cgroup = m[1]
+		return nil, false
+	}
+
+	if m := oomKillMemcg.FindStringSubmatch(msg); m != nil {
+		p.cgroup = m[1]
+		return nil, false
+	}
+
+	m := oomKilled.FindStringSubmatch(msg)
+	if m == nil {
+		return nil, false
+	}
+
+	k := &OOMKill{Command: m[2], Cgroup: p.cgroup}
+	k.Pid, _ = strconv.Atoi(m[1])
+
+	for _, kb := range m[3:] {
+		v, _ := strconv.ParseUint(kb, 10, 64)
+		k.RSS += v * 1024
+	}
+
+	if c := oomContainerId.FindStringSubmatch(p.cgroup); c != nil {
+		k.ContainerID = c[1]
+	}
+
+	p.cgroup = ""
+
+	return k, true
+}
+
+// handleKernelOOM tells the app which of its processes the kernel OOM killer stopped
+func (m *Monitor) handleKernelOOM(k *OOMKill) {
+	rss := fmt.Sprintf("%dMB", k.RSS/1024/1024)
+
+	if k.ContainerID == "" {
+		m.logSystemf("dmesg handleKernelOOM pid=%d command=%s cgroup=%s rss=%s count#KernelOOMKill=1", k.Pid, k.Command, k.Cgroup, rss)
+		m.metrics.Count("KernelOOMKill", m.dimensions(), 1)
+		return
+	}
+
+	env, _ := m.getEnv(k.ContainerID)
+
+	m.logSystemf("dmesg handleKernelOOM id=%s app=%s process=%s pid=%d command=%s rss=%s count#KernelOOMKill=1", k.ContainerID, appName(env), env["PROCESS"], k.Pid, k.Command, rss)
+	m.metrics.Count("KernelOOMKill", m.dimensions("app", appName(env), "process", env["PROCESS"]), 1)
+
+	if !m.markOOM(k.ContainerID) {
+		return
+	}
+
+	msg := fmt.Sprintf("Stopped process %s due to OOM (rss=%s)", k.ContainerID[0:12], rss)
+	if p := env["PROCESS"]; p != "" {
+		msg = fmt.Sprintf("Stopped %s process %s due to OOM (rss=%s)", p, k.ContainerID[0:12], rss)
+	}
+
+	m.logAppEventFields(k.ContainerID, msg, map[string]interface{}{
+		"pid":       k.Pid,
+		"command":   k.Command,
+		"cgroup":    k.Cgroup,
+		"rss_bytes": k.RSS,
+	})
+}
+
+// markOOM records an OOM app event for a container and returns false if one was already sent recently
+func (m *Monitor) markOOM(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if last, ok := m.ooms[id]; ok && time.Since(last) < OOM_DEDUPE_WINDOW {
+		return false
+	}
+
+	m.ooms[id] = time.Now()
+
+	return true
+}
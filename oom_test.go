@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOOMParser(t *testing.T) {
+	id := "1d11a78279e0cd3e1d11a78279e0cd3e1d11a78279e0cd3e1d11a78279e0cd3e"
+
+	p := &OOMParser{}
+
+	// before linux 4.19
+	_, ok := p.Feed("java invoked oom-killer: gfp_mask=0xd0, order=0, oom_score_adj=0")
+	assert.False(t, ok)
+
+	_, ok = p.Feed("Task in /docker/" + id + " killed as a result of limit of /docker/" + id)
+	assert.False(t, ok)
+
+	k, ok := p.Feed("Killed process 4321 (java) total-vm:2340000kB, anon-rss:523264kB, file-rss:1024kB")
+	assert.True(t, ok)
+	assert.Equal(t, &OOMKill{Pid: 4321, Command: "java", Cgroup: "/docker/" + id, ContainerID: id, RSS: 524288 * 1024}, k)
+
+	// linux 4.19+ with ecs task cgroups
+	_, ok = p.Feed("oom-kill:constraint=CONSTRAINT_MEMCG,nodemask=(null),cpuset=" + id + ",mems_allowed=0,oom_memcg=/ecs/b2c6a7a1/" + id + ",task_memcg=/ecs/b2c6a7a1/" + id + ",task=node,pid=99,uid=0")
+	assert.False(t, ok)
+
+	k, ok = p.Feed("Memory cgroup out of memory: Killed process 99 (node) total-vm:1000kB, anon-rss:2048kB, file-rss:1024kB, shmem-rss:1024kB, UID:0 pgtables:100kB oom_score_adj:0")
+	assert.True(t, ok)
+	assert.Equal(t, id, k.ContainerID)
+	assert.Equal(t, uint64(4096*1024), k.RSS)
+
+	// a host process outside of any container
+	k, ok = p.Feed("Out of memory: Killed process 12 (sshd) total-vm:100kB, anon-rss:10kB, file-rss:0kB, shmem-rss:0kB")
+	assert.True(t, ok)
+	assert.Equal(t, "", k.ContainerID)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Prometheus metric names are the registry names in snake case with this prefix
+var PROMETHEUS_PREFIX = "convox_"
+
+// ServeMetrics exposes the metrics registry at /metrics in the Prometheus text format
+// The listen address is configured with the METRICS_ADDR env (default :9102)
+func (m *Monitor) ServeMetrics() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = ":9102"
+	}
+
+	m.logSystemf("prometheus at=start addr=%s", addr)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, m.metrics.Snapshot())
+	})
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		m.logSystemf("prometheus ListenAndServe addr=%s count#PrometheusListenError=1 err=%q", addr, err)
+	}
+}
+
+// writePrometheus writes series in the text exposition format
+// counters get a _total suffix and histograms are written as summaries with _count and _sum
+func writePrometheus(w io.Writer, series []MetricSeries) {
+	families := map[string][]MetricSeries{}
+	names := []string{}
+
+	for _, s := range series {
+		name := PROMETHEUS_PREFIX + snakeCase(s.Name)
+
+		if s.Kind == "counter" {
+			name += "_total"
+		}
+
+		if _, ok := families[name]; !ok {
+			names = append(names, name)
+		}
+
+		families[name] = append(families[name], s)
+	}
+
+	for _, name := range names {
+		family := families[name]
+
+		switch family[0].Kind {
+		case "counter", "gauge":
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, family[0].Kind)
+
+			for _, s := range family {
+				fmt.Fprintf(w, "%s%s %g\n", name, prometheusLabels(s.Dimensions), s.Value)
+			}
+		case "histogram":
+			fmt.Fprintf(w, "# TYPE %s summary\n", name)
+
+			for _, s := range family {
+				labels := prometheusLabels(s.Dimensions)
+				fmt.Fprintf(w, "%s_count%s %g\n", name, labels, s.TotalCount)
+				fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, s.TotalSum)
+			}
+		}
+	}
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabels(dims Dimensions) string {
+	if len(dims) == 0 {
+		return ""
+	}
+
+	labels := []string{}
+
+	for _, k := range sortedKeys(dims) {
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", snakeCase(k), prometheusEscaper.Replace(dims[k])))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// snakeCase converts names like KinesisPutRecordsError, instanceId or disk.utilization to valid
+// Prometheus names like kinesis_put_records_error, instance_id and disk_utilization
+func snakeCase(name string) string {
+	rs := []rune(name)
+	out := []rune{}
+
+	for i, r := range rs {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(rs[i-1]) || unicode.IsDigit(rs[i-1]) || (i+1 < len(rs) && unicode.IsLower(rs[i+1]) && unicode.IsUpper(rs[i-1]))) {
+				out = append(out, '_')
+			}
+			out = append(out, unicode.ToLower(r))
+		case unicode.IsLower(r), unicode.IsDigit(r):
+			out = append(out, r)
+		default:
+			if len(out) > 0 && out[len(out)-1] != '_' {
+				out = append(out, '_')
+			}
+		}
+	}
+
+	return string(out)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	ms := NewMetrics()
+
+	ms.Count("KinesisPutRecordsError", Dimensions{"instanceId": "i-553ffcd2", "stream": "convox-Kinesis"}, 2)
+	ms.Gauge("disk.utilization", Dimensions{"instanceId": "i-553ffcd2", "volume": "root"}, 16.02)
+	ms.Observe("DockerPsLatency", Dimensions{"instanceId": "i-553ffcd2"}, 0.5)
+	ms.Observe("DockerPsLatency", Dimensions{"instanceId": "i-553ffcd2"}, 1.5)
+	ms.Count("LinesForwarded", Dimensions{"app": `my"app`}, 1)
+
+	// flushing to CloudWatch does not reset the exposed values
+	ms.Flush()
+
+	buf := &bytes.Buffer{}
+	writePrometheus(buf, ms.Snapshot())
+
+	assert.Equal(t, `# TYPE convox_docker_ps_latency summary
+convox_docker_ps_latency_count{instance_id="i-553ffcd2"} 2
+convox_docker_ps_latency_sum{instance_id="i-553ffcd2"} 2
+# TYPE convox_kinesis_put_records_error_total counter
+convox_kinesis_put_records_error_total{instance_id="i-553ffcd2",stream="convox-Kinesis"} 2
+# TYPE convox_lines_forwarded_total counter
+convox_lines_forwarded_total{app="my\"app"} 1
+# TYPE convox_disk_utilization gauge
+convox_disk_utilization{instance_id="i-553ffcd2",volume="root"} 16.02
+`, buf.String())
+}
+
+func TestSnakeCase(t *testing.T) {
+	assert.Equal(t, "kinesis_put_records_error", snakeCase("KinesisPutRecordsError"))
+	assert.Equal(t, "instance_id", snakeCase("instanceId"))
+	assert.Equal(t, "disk_utilization", snakeCase("disk.utilization"))
+	assert.Equal(t, "docker_rm", snakeCase("docker.rm"))
+	assert.Equal(t, "ecs_agent_image", snakeCase("ECSAgentImage"))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// suppressed line counts are reported to the app on this interval
+var RATE_LIMIT_REPORT_INTERVAL = 1 * time.Minute
+
+// RateLimiter is a per-container token bucket limit on forwarded log lines
+// It is configured with container env:
+//
+// LOG_RATE_LINES=100     lines per second
+// LOG_RATE_BYTES=65536   bytes per second
+// LOG_RATE_BURST=5       seconds worth of lines and bytes that can be forwarded at once (default 1)
+// LOG_RATE_SAMPLE=10     forward 1 in 10 lines over the limit instead of dropping them all
+type RateLimiter struct {
+	lock       sync.Mutex
+	lines      *tokenBucket
+	bytes      *tokenBucket
+	sample     int
+	over       int
+	suppressed int
+}
+
+// NewRateLimiter returns nil if the container env does not set a rate
+func NewRateLimiter(env map[string]string) (*RateLimiter, error) {
+	lines, err := envFloat(env, "LOG_RATE_LINES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := envFloat(env, "LOG_RATE_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if lines <= 0 && bytes <= 0 {
+		return nil, nil
+	}
+
+	burst, err := envFloat(env, "LOG_RATE_BURST", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	sample, err := envFloat(env, "LOG_RATE_SAMPLE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RateLimiter{sample: int(sample)}
+
+	if lines > 0 {
+		l.lines = newTokenBucket(lines, lines*burst)
+	}
+
+	if bytes > 0 {
+		l.bytes = newTokenBucket(bytes, bytes*burst)
+	}
+
+	return l, nil
+}
+
+// Allow reports if a line of size bytes should be forwarded
+func (l *RateLimiter) Allow(size int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	l.lines.refill(now)
+	l.bytes.refill(now)
+
+	if l.lines.has(1) && l.bytes.has(float64(size)) {
+		l.lines.take(1)
+		l.bytes.take(float64(size))
+		return true
+	}
+
+	l.over += 1
+
+	if l.sample > 0 && (l.over-1)%l.sample == 0 {
+		return true
+	}
+
+	l.suppressed += 1
+
+	return false
+}
+
+// Suppressed returns how many lines were dropped since the last call
+func (l *RateLimiter) Suppressed() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n := l.suppressed
+	l.suppressed = 0
+
+	return n
+}
+
+// tokenBucket refills at rate tokens per second up to capacity
+// A nil bucket has no limit
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate, capacity float64) *tokenBucket {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// has reports if the bucket can take n tokens
+// A line larger than the bucket fits when the bucket is full so it can't be held back forever
+func (b *tokenBucket) has(n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	return b.tokens >= n || b.tokens == b.capacity
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b == nil {
+		return
+	}
+
+	b.tokens -= n
+
+	if b.tokens < 0 {
+		b.tokens = 0
+	}
+}
+
+// reportSuppressed periodically tells apps how many lines their containers had suppressed by a rate limit
+func (m *Monitor) reportSuppressed() {
+	for _ = range time.Tick(RATE_LIMIT_REPORT_INTERVAL) {
+		m.lock.Lock()
+		limiters := map[string]*RateLimiter{}
+		for id, l := range m.limiters {
+			limiters[id] = l
+		}
+		m.lock.Unlock()
+
+		for id, l := range limiters {
+			if l == nil {
+				continue
+			}
+
+			n := l.Suppressed()
+			if n == 0 {
+				continue
+			}
+
+			env, _ := m.getEnv(id)
+
+			m.logSystemf("container reportSuppressed id=%s app=%s process=%s count#LinesSuppressed=%d", id, appName(env), env["PROCESS"], n)
+			m.metrics.Count("LinesSuppressed", m.dimensions("app", appName(env), "process", env["PROCESS"]), float64(n))
+
+			msg := fmt.Sprintf("Suppressed %d lines from process %s over the log rate limit", n, shortId(id))
+			if p := env["PROCESS"]; p != "" {
+				msg = fmt.Sprintf("Suppressed %d lines from %s process %s over the log rate limit", n, p, shortId(id))
+			}
+
+			m.logAppEvent(id, msg)
+		}
+	}
+}
+
+func envFloat(env map[string]string, name string, def float64) (float64, error) {
+	v := env[name]
+	if v == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+
+	return f, nil
+}
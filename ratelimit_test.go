@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterDrop(t *testing.T) {
+	l, err := NewRateLimiter(map[string]string{"LOG_RATE_LINES": "2", "LOG_RATE_BURST": "2"})
+	assert.Nil(t, err)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.Allow(10) {
+			allowed += 1
+		}
+	}
+
+	assert.Equal(t, 4, allowed)
+	assert.Equal(t, 6, l.Suppressed())
+	assert.Equal(t, 0, l.Suppressed())
+}
+
+func TestRateLimiterSample(t *testing.T) {
+	l, err := NewRateLimiter(map[string]string{"LOG_RATE_BYTES": "100", "LOG_RATE_SAMPLE": "3"})
+	assert.Nil(t, err)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if l.Allow(50) {
+			allowed += 1
+		}
+	}
+
+	// 2 lines fit in the bucket, then 1 in 3 of the 8 over the limit
+	assert.Equal(t, 5, allowed)
+	assert.Equal(t, 5, l.Suppressed())
+}
+
+func TestRateLimiterConfig(t *testing.T) {
+	l, err := NewRateLimiter(map[string]string{})
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+
+	_, err = NewRateLimiter(map[string]string{"LOG_RATE_LINES": "lots"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactDetectors are the built-in rules a container can turn on with LOG_REDACT=aws,bearer,card,email (or all)
+var RedactDetectors = map[string]*redactRule{
+	"aws":    {name: "aws", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b|(?i)aws_secret_access_key["']?\s*[=:]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	"bearer": {name: "bearer", re: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]+=*`)},
+	"card":   {name: "card", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	"email":  {name: "email", re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+}
+
+type redactRule struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(match string) bool // optional check to cut down on false positives
+}
+
+// Redactor masks secrets and PII in container log lines before they are forwarded to any sink
+// Built-in detectors are picked with the LOG_REDACT env, and custom regexes come from
+// the LOG_REDACT_PATTERN env or convox.redact.<name> labels
+type Redactor struct {
+	rules []*redactRule
+}
+
+// NewRedactor returns nil if the container has no redaction rules
+func NewRedactor(env, labels map[string]string) (*Redactor, error) {
+	r := &Redactor{}
+
+	for _, name := range strings.Split(env["LOG_REDACT"], ",") {
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case "":
+		case "all":
+			for _, d := range sortedDetectors() {
+				r.rules = append(r.rules, d)
+			}
+		default:
+			d, ok := RedactDetectors[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown LOG_REDACT detector: %s", name)
+			}
+
+			r.rules = append(r.rules, d)
+		}
+	}
+
+	custom := map[string]string{}
+
+	if p := env["LOG_REDACT_PATTERN"]; p != "" {
+		custom["pattern"] = p
+	}
+
+	for k, v := range labels {
+		if strings.HasPrefix(k, "convox.redact.") {
+			custom[strings.TrimPrefix(k, "convox.redact.")] = v
+		}
+	}
+
+	names := []string{}
+	for name := range custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		re, err := regexp.Compile(custom[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %s: %s", name, err)
+		}
+
+		r.rules = append(r.rules, &redactRule{name: name, re: re})
+	}
+
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+
+	return r, nil
+}
+
+// Redact returns the line with every match replaced by [REDACTED:<rule>] and the names of the rules that matched
+func (r *Redactor) Redact(line string) (string, []string) {
+	matched := []string{}
+
+	for _, rule := range r.rules {
+		hit := false
+
+		line = rule.re.ReplaceAllStringFunc(line, func(m string) string {
+			if rule.valid != nil && !rule.valid(m) {
+				return m
+			}
+
+			hit = true
+			return "[REDACTED:" + rule.name + "]"
+		})
+
+		if hit {
+			matched = append(matched, rule.name)
+		}
+	}
+
+	return line, matched
+}
+
+func sortedDetectors() []*redactRule {
+	names := []string{}
+	for name := range RedactDetectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rules := []*redactRule{}
+	for _, name := range names {
+		rules = append(rules, RedactDetectors[name])
+	}
+
+	return rules
+}
+
+// luhn validates a credit card number checksum, ignoring spaces and dashes
+func luhn(s string) bool {
+	sum := 0
+	double := false
+	digits := 0
+
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+
+		if c == ' ' || c == '-' {
+			continue
+		}
+
+		d := int(c - '0')
+		digits += 1
+
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+		double = !double
+	}
+
+	return digits >= 13 && sum%10 == 0
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// LogRecord is a parsed container log line or agent event
+// Every registered LogSink receives the same record and is responsible for its own formatting
+type LogRecord struct {
+	Timestamp   time.Time
+	App         string
+	Process     string
+	Release     string
+	ContainerID string
+	Line        []byte
+
+	// Stream is "stdout" or "stderr" for container output
+	Stream string
+
+	// Format is the container LOG_FORMAT env, "json" for a structured envelope or empty for the legacy line
+	Format string
+
+	// Prefix is set by the container LOG_STREAM_PREFIX=true env to add the stream to legacy lines
+	Prefix bool
+
+	// Event is set for messages generated by the agent, i.e. "Starting web process 1d11a78279e0"
+	Event bool
+
+	// Fields are structured details of an event, i.e. {"exit_code": 137}, included in JSON records
+	Fields map[string]interface{}
+}
+
+// LogSink is a destination for container logs and app events
+type LogSink interface {
+	Name() string
+	Write(r *LogRecord) error
+
+	// Flush delivers everything the sink has buffered, it is called before the agent stops
+	Flush() error
+
+	// Close releases anything a sink holds for a container once its logs have ended
+	Close(id string) error
+}
+
+// LogSinks are constructed by name from the LOG_SINKS env, i.e. LOG_SINKS=cloudwatch,kinesis
+var LogSinks = map[string]func(m *Monitor) LogSink{
+	"cloudwatch": NewCloudWatchSink,
+	"kinesis":    NewKinesisSink,
+}
+
+const DEFAULT_LOG_SINKS = "cloudwatch,kinesis"
+
+// RegisterLogSink makes a sink available to LOG_SINKS
+func RegisterLogSink(name string, fn func(m *Monitor) LogSink) {
+	LogSinks[name] = fn
+}
+
+func (m *Monitor) startSinks() []LogSink {
+	names := os.Getenv("LOG_SINKS")
+	if names == "" {
+		names = DEFAULT_LOG_SINKS
+	}
+
+	sinks := []LogSink{}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		fn, ok := LogSinks[name]
+		if !ok {
+			fmt.Printf("NewMonitor startSinks sink=%s err=%q\n", name, "unknown sink")
+			continue
+		}
+
+		sinks = append(sinks, fn(m))
+	}
+
+	return sinks
+}
+
+// forward hands a record to every sink
+func (m *Monitor) forward(r *LogRecord) {
+	for _, s := range m.sinks {
+		if err := s.Write(r); err != nil {
+			m.logSystemf("container forward sink=%s count#LogSinkWriteError=1 err=%q", s.Name(), err)
+			m.metrics.Count("LogSinkWriteError", m.dimensions("sink", s.Name()), 1)
+		}
+	}
+}
+
+// flushSinks flushes every sink
+func (m *Monitor) flushSinks() {
+	for _, s := range m.sinks {
+		if err := s.Flush(); err != nil {
+			m.logSystemf("container flushSinks sink=%s count#LogSinkFlushError=1 err=%q", s.Name(), err)
+			m.metrics.Count("LogSinkFlushError", m.dimensions("sink", s.Name()), 1)
+		}
+	}
+}
+
+// closeSinks closes every sink for a container
+func (m *Monitor) closeSinks(id string) {
+	for _, s := range m.sinks {
+		if err := s.Close(id); err != nil {
+			m.logSystemf("container closeSinks id=%s sink=%s count#LogSinkCloseError=1 err=%q", id, s.Name(), err)
+			m.metrics.Count("LogSinkCloseError", m.dimensions("sink", s.Name()), 1)
+			m.ReportError(err)
+		}
+	}
+}
+
+// legacyLine formats a record with the syslog-ish prefix that has always been sent to CloudWatch and Kinesis:
+// web:RXZMCQEPDKO/1d11a78279e0 Hello from Docker.
+// web:RXZMCQEPDKO/1d11a78279e0 [stderr] Hello from Docker. (with LOG_STREAM_PREFIX=true)
+// agent:0.73/i-553ffcd2 Starting web process 1d11a78279e0
+func (m *Monitor) legacyLine(r *LogRecord) string {
+	if r.Event {
+		return fmt.Sprintf("agent:%s/%s %s", m.agentVersion, m.instanceId, r.Line)
+	}
+
+	if r.Prefix && r.Stream != "" {
+		return fmt.Sprintf("%s:%s/%s [%s] %s", r.Process, r.Release, shortId(r.ContainerID), r.Stream, r.Line)
+	}
+
+	return fmt.Sprintf("%s:%s/%s %s", r.Process, r.Release, shortId(r.ContainerID), r.Line)
+}
+
+// jsonRecord is the structured envelope sent for containers with LOG_FORMAT=json
+type jsonRecord struct {
+	Timestamp   string `json:"timestamp"`
+	App         string `json:"app"`
+	Process     string `json:"process"`
+	Release     string `json:"release"`
+	ContainerID string `json:"container_id"`
+	InstanceID  string `json:"instance_id"`
+	Stream      string `json:"stream,omitempty"`
+	Message     string `json:"message"`
+	Event       bool   `json:"event,omitempty"`
+
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// jsonLine formats a record as a JSON envelope
+// {"timestamp":"2016-04-20T17:59:27.123456789Z","app":"myapp","process":"web","release":"RXZMCQEPDKO","container_id":"1d11a78279e0...","instance_id":"i-553ffcd2","stream":"stdout","message":"Hello from Docker."}
+func (m *Monitor) jsonLine(r *LogRecord) ([]byte, error) {
+	return json.Marshal(jsonRecord{
+		Timestamp:   r.Timestamp.UTC().Format(time.RFC3339Nano),
+		App:         r.App,
+		Process:     r.Process,
+		Release:     r.Release,
+		ContainerID: r.ContainerID,
+		InstanceID:  m.instanceId,
+		Stream:      r.Stream,
+		Message:     string(r.Line),
+		Event:       r.Event,
+		Fields:      r.Fields,
+	})
+}
+
+// CloudWatchSink writes records to the per-container awslogs logger created in handleCreate
+type CloudWatchSink struct {
+	monitor *Monitor
+}
+
+func NewCloudWatchSink(m *Monitor) LogSink {
+	return &CloudWatchSink{monitor: m}
+}
+
+func (s *CloudWatchSink) Name() string {
+	return "cloudwatch"
+}
+
+func (s *CloudWatchSink) Write(r *LogRecord) error {
+	awslogger, ok := s.monitor.getLogger(r.ContainerID)
+	if !ok {
+		return nil
+	}
+
+	line := []byte(s.monitor.legacyLine(r))
+
+	if r.Format == "json" {
+		data, err := s.monitor.jsonLine(r)
+		if err != nil {
+			return err
+		}
+
+		line = data
+	}
+
+	return awslogger.Log(&logger.Message{
+		ContainerID: r.ContainerID,
+		Line:        line,
+		Timestamp:   r.Timestamp,
+	})
+}
+
+// flusher is implemented by the awslogs logger
+type flusher interface {
+	Flush() error
+}
+
+// Flush publishes the lines every awslogger has batched and waits for them to be put
+func (s *CloudWatchSink) Flush() error {
+	s.monitor.lock.Lock()
+	loggers := []logger.Logger{}
+	for _, l := range s.monitor.loggers {
+		loggers = append(loggers, l)
+	}
+	s.monitor.lock.Unlock()
+
+	var last error
+
+	for _, l := range loggers {
+		if f, ok := l.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				last = err
+			}
+		}
+	}
+
+	return last
+}
+
+// Close publishes the lines the container awslogger has batched and stops it
+func (s *CloudWatchSink) Close(id string) error {
+	awslogger, ok := s.monitor.getLogger(id)
+	if !ok {
+		return nil
+	}
+
+	return awslogger.Close()
+}
+
+// KinesisSink buffers records for the container KINESIS stream which streamLogs puts in batches
+type KinesisSink struct {
+	monitor *Monitor
+}
+
+func NewKinesisSink(m *Monitor) LogSink {
+	return &KinesisSink{monitor: m}
+}
+
+func (s *KinesisSink) Name() string {
+	return "kinesis"
+}
+
+func (s *KinesisSink) Write(r *LogRecord) error {
+	env, _ := s.monitor.getEnv(r.ContainerID)
+
+	stream := env["KINESIS"]
+	if stream == "" {
+		return nil
+	}
+
+	// add timestamp to kinesis for legacy purposes
+	data := []byte(fmt.Sprintf("%s %s", r.Timestamp.Format("2006-01-02 15:04:05"), s.monitor.legacyLine(r)))
+
+	if r.Format == "json" {
+		j, err := s.monitor.jsonLine(r)
+		if err != nil {
+			return err
+		}
+
+		data = j
+	}
+
+	if r.Event {
+		s.monitor.addEvent(stream, s.monitor.partitionKey(r, env), data)
+	} else {
+		s.monitor.addLine(stream, s.monitor.partitionKey(r, env), data)
+	}
+
+	return nil
+}
+
+// Flush waits up to KINESIS_FLUSH_TIMEOUT for streamLogs to put the buffered lines
+// Lines still buffered after that are in the spool for the next agent to put.
+func (s *KinesisSink) Flush() error {
+	deadline := time.Now().Add(KINESIS_FLUSH_TIMEOUT)
+
+	for {
+		n := s.monitor.bufferedLines()
+
+		if n == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d records still buffered", n)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Kinesis streams are shared by containers and drained by streamLogs, so there is nothing to close
+func (s *KinesisSink) Close(id string) error {
+	return nil
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[0:12]
+	}
+	return id
+}
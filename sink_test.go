@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRecordFormats(t *testing.T) {
+	m := &Monitor{agentVersion: "0.73", instanceId: "i-553ffcd2"}
+
+	r := &LogRecord{
+		Timestamp:   time.Date(2016, 4, 20, 17, 59, 27, 123456789, time.UTC),
+		App:         "myapp",
+		Process:     "web",
+		Release:     "RXZMCQEPDKO",
+		ContainerID: "1d11a78279e0cd3e",
+		Stream:      "stdout",
+		Line:        []byte("Hello from Docker."),
+	}
+
+	assert.Equal(t, "web:RXZMCQEPDKO/1d11a78279e0 Hello from Docker.", m.legacyLine(r))
+
+	data, err := m.jsonLine(r)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"timestamp":"2016-04-20T17:59:27.123456789Z","app":"myapp","process":"web","release":"RXZMCQEPDKO","container_id":"1d11a78279e0cd3e","instance_id":"i-553ffcd2","stream":"stdout","message":"Hello from Docker."}`, string(data))
+
+	r.Prefix = true
+	r.Stream = "stderr"
+
+	assert.Equal(t, "web:RXZMCQEPDKO/1d11a78279e0 [stderr] Hello from Docker.", m.legacyLine(r))
+
+	r.Event = true
+	r.Stream = ""
+	r.Line = []byte("Starting web process 1d11a78279e0")
+
+	assert.Equal(t, "agent:0.73/i-553ffcd2 Starting web process 1d11a78279e0", m.legacyLine(r))
+}
+
+type testSink struct {
+	records []*LogRecord
+	flushed int
+	closed  []string
+}
+
+func (s *testSink) Name() string {
+	return "test"
+}
+
+func (s *testSink) Write(r *LogRecord) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	s.flushed += 1
+	return nil
+}
+
+func (s *testSink) Close(id string) error {
+	s.closed = append(s.closed, id)
+	return nil
+}
+
+func TestLogSinks(t *testing.T) {
+	sink := &testSink{}
+
+	RegisterLogSink("test", func(m *Monitor) LogSink { return sink })
+	defer delete(LogSinks, "test")
+
+	os.Setenv("LOG_SINKS", "test, unknown")
+	defer os.Unsetenv("LOG_SINKS")
+
+	m := &Monitor{metrics: NewMetrics()}
+	m.sinks = m.startSinks()
+
+	assert.Equal(t, 1, len(m.sinks))
+
+	r := &LogRecord{ContainerID: "1d11a78279e0", Line: []byte("Hello from Docker.")}
+
+	m.forward(r)
+	m.flushSinks()
+	m.closeSinks("1d11a78279e0")
+
+	assert.Equal(t, []*LogRecord{r}, sink.records)
+	assert.Equal(t, 1, sink.flushed)
+	assert.Equal(t, []string{"1d11a78279e0"}, sink.closed)
+}
+
+func TestKinesisSinkFlush(t *testing.T) {
+	defer func(timeout time.Duration) { KINESIS_FLUSH_TIMEOUT = timeout }(KINESIS_FLUSH_TIMEOUT)
+
+	KINESIS_FLUSH_TIMEOUT = 50 * time.Millisecond
+
+	m := kinesisMonitor(bufferLimits{Stream: 1024, Total: 1024})
+	s := NewKinesisSink(m)
+
+	assert.Nil(t, s.Flush())
+
+	m.addLine("stream", "key", []byte("queued"))
+
+	assert.EqualError(t, s.Flush(), "1 records still buffered")
+
+	m.getLines("stream")
+
+	assert.Nil(t, s.Flush())
+}
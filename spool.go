@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var SPOOL_SEGMENT_BYTES int64 = 4 * 1024 * 1024
+
+// Spool is a segmented write-ahead log of Kinesis records for one stream
+// Every record is appended to the active segment before it is buffered in memory,
+// and a segment file is removed once Kinesis has acknowledged all of its records.
+//
+// Records are framed as:
+// uint32 key length | uint32 data length | key | data
+type Spool struct {
+	dir string
+
+	lock     sync.Mutex
+	active   *os.File
+	activeId uint64
+	size     int64
+	pending  map[uint64]int // segment id -> unacknowledged records
+}
+
+// kinesisRecord is a buffered line waiting to be put to Kinesis
+type kinesisRecord struct {
+	Data []byte
+	Key  string
+
+	retry *kinesisRetry
+
+	segment uint64
+	spool   *Spool
+}
+
+// ack releases a delivered record from its spool segment
+func (r *kinesisRecord) ack() error {
+	if r.spool == nil {
+		return nil
+	}
+
+	return r.spool.Ack(r)
+}
+
+func (r *kinesisRecord) size() int {
+	return len(r.Key) + len(r.Data)
+}
+
+// OpenSpool replays any segments left by a previous agent and starts a new active segment
+func OpenSpool(dir string) (*Spool, []*kinesisRecord, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	s := &Spool{
+		dir:     dir,
+		pending: map[uint64]int{},
+	}
+
+	ids, err := s.segments()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := []*kinesisRecord{}
+
+	for _, id := range ids {
+		rs, err := s.replay(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(rs) == 0 {
+			os.Remove(s.path(id))
+			continue
+		}
+
+		s.pending[id] = len(rs)
+		s.activeId = id
+		records = append(records, rs...)
+	}
+
+	if err := s.rotate(); err != nil {
+		return nil, nil, err
+	}
+
+	return s, records, nil
+}
+
+// Append writes a record to the active segment
+func (s *Spool) Append(key string, data []byte) (*kinesisRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.size >= SPOOL_SEGMENT_BYTES {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	frame := make([]byte, 8+len(key)+len(data))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(key)))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(data)))
+	copy(frame[8:], key)
+	copy(frame[8+len(key):], data)
+
+	n, err := s.active.Write(frame)
+	s.size += int64(n)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pending[s.activeId] += 1
+
+	return &kinesisRecord{Data: data, Key: key, segment: s.activeId, spool: s}, nil
+}
+
+// Ack marks a record as delivered and removes its segment when nothing in it is pending
+func (s *Spool) Ack(r *kinesisRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pending[r.segment] -= 1
+
+	if s.pending[r.segment] > 0 || r.segment == s.activeId {
+		return nil
+	}
+
+	delete(s.pending, r.segment)
+
+	return os.Remove(s.path(r.segment))
+}
+
+// rotate closes the active segment and opens the next one
+// the previous segment is removed if everything in it was already acknowledged
+func (s *Spool) rotate() error {
+	if s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+
+		if s.pending[s.activeId] == 0 {
+			delete(s.pending, s.activeId)
+			os.Remove(s.path(s.activeId))
+		}
+	}
+
+	s.activeId += 1
+
+	f, err := os.OpenFile(s.path(s.activeId), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.active = f
+	s.size = 0
+
+	return nil
+}
+
+func (s *Spool) replay(id uint64) ([]*kinesisRecord, error) {
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	records := []*kinesisRecord{}
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			break // EOF or a frame header cut short by a crash
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(header[0:4])+binary.BigEndian.Uint32(header[4:8]))
+
+		if _, err := io.ReadFull(br, body); err != nil {
+			break // frame cut short by a crash
+		}
+
+		kl := binary.BigEndian.Uint32(header[0:4])
+
+		records = append(records, &kinesisRecord{
+			Key:     string(body[0:kl]),
+			Data:    body[kl:],
+			segment: id,
+			spool:   s,
+		})
+	}
+
+	return records, nil
+}
+
+// segments returns the ids of existing segment files in order
+func (s *Spool) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uint64{}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".seg") {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Sort(uint64s(ids))
+
+	return ids, nil
+}
+
+func (s *Spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+type uint64s []uint64
+
+func (a uint64s) Len() int           { return len(a) }
+func (a uint64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, records, err := OpenSpool(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(records))
+
+	r1, err := s.Append("web", []byte("one"))
+	assert.Nil(t, err)
+
+	_, err = s.Append("web", []byte("two"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, r1.ack())
+
+	// a restarted agent replays everything in the segment that was not removed
+	_, records, err = OpenSpool(dir)
+	assert.Nil(t, err)
+
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "web", records[0].Key)
+		assert.Equal(t, []byte("one"), records[0].Data)
+		assert.Equal(t, []byte("two"), records[1].Data)
+	}
+}
+
+func TestSpoolRemovesAcknowledgedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(size int64) { SPOOL_SEGMENT_BYTES = size }(SPOOL_SEGMENT_BYTES)
+	SPOOL_SEGMENT_BYTES = 1
+
+	s, _, err := OpenSpool(dir)
+	assert.Nil(t, err)
+
+	r1, _ := s.Append("web", []byte("one"))
+	r2, _ := s.Append("web", []byte("two"))
+	s.Append("web", []byte("three"))
+
+	assert.Nil(t, r1.ack())
+	assert.Nil(t, r2.ack())
+
+	_, records, err := OpenSpool(dir)
+	assert.Nil(t, err)
+
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, []byte("three"), records[0].Data)
+	}
+}
+
+func TestGetSpoolReplays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s, _, err := OpenSpool(filepath.Join(dir, "stream"))
+	assert.Nil(t, err)
+
+	_, err = s.Append("web", []byte("one"))
+	assert.Nil(t, err)
+
+	m := kinesisMonitor(bufferLimits{Stream: 100, Total: 100})
+	m.spoolDir = dir
+	delete(m.spools, "stream")
+
+	m.replaySpools()
+
+	assert.NotNil(t, m.spools["stream"])
+
+	if assert.Equal(t, 1, len(m.lines["stream"])) {
+		assert.Equal(t, []byte("one"), m.lines["stream"][0].Data)
+	}
+
+	// later lookups return the open spool without replaying again
+	assert.Equal(t, m.spools["stream"], m.getSpool("stream"))
+	assert.Equal(t, 1, len(m.lines["stream"]))
+}
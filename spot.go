@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -27,45 +28,79 @@ func (m *Monitor) Spot() {
 		if os.Getenv("DEVELOPMENT") != "true" && svc.Available() {
 			tt, err := svc.GetMetadata("spot/termination-time")
 			if err != nil {
+				// not found until a termination is scheduled
+				m.metrics.Gauge("SpotTerminationScheduled", m.dimensions(), 0)
 				m.logSystemf("Unable to fetch termination time")
 			} else {
 				ts, err := time.Parse(time.RFC3339, tt)
 				if err != nil {
 					m.logSystemf("Unable to parse termination time")
 				} else {
+					m.metrics.Gauge("SpotTerminationScheduled", m.dimensions(), 1)
+					m.metrics.Gauge("SpotTerminationSeconds", m.dimensions(), ts.Sub(time.Now()).Seconds())
 					m.logSystemf("Termination notice: %s", ts)
-					instanceArn := m.getECSMetadata("ContainerInstanceArn")
-					cluster := m.getECSMetadata("Cluster")
-					m.setInstanceDraining(instanceArn, cluster)
+					if err := m.drainInstance(); err != nil {
+						m.logSystemf("Unable to drain instance: %s", err)
+					}
 				}
 			}
 		}
 	}
 }
 
-func (m *Monitor) getECSMetadata(key string) string {
-	resp, err := http.Get("http://localhost:51678/v1/metadata")
+// ECS_METADATA_URL is the ECS agent introspection API
+var ECS_METADATA_URL = "http://localhost:51678/v1/metadata"
+
+func (m *Monitor) getECSMetadata(key string) (string, error) {
+	resp, err := http.Get(ECS_METADATA_URL)
 	if err != nil {
-		m.logSystemf("Unable to fetch instance ARN")
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ecs metadata: %s", resp.Status)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		m.logSystemf("Unable to read metadata response body")
+		return "", err
 	}
 
 	var metadata map[string]interface{}
 
 	if err = json.Unmarshal(body, &metadata); err != nil {
-		m.logSystemf("Unable to decode JSON metadata")
+		return "", err
+	}
+
+	v, ok := metadata[key].(string)
+	if !ok || v == "" {
+		return "", fmt.Errorf("ecs metadata: no %s", key)
+	}
+
+	return v, nil
+}
+
+// drainInstance sets this ECS container instance to DRAINING so tasks move off it
+func (m *Monitor) drainInstance() error {
+	instanceArn, err := m.getECSMetadata("ContainerInstanceArn")
+	if err != nil {
+		return err
 	}
 
-	return metadata[key].(string)
+	cluster, err := m.getECSMetadata("Cluster")
+	if err != nil {
+		return err
+	}
+
+	return m.setInstanceDraining(instanceArn, cluster)
 }
 
-func (m *Monitor) setInstanceDraining(instanceArn, cluster string) {
+func (m *Monitor) setInstanceDraining(instanceArn, cluster string) error {
 	err := exec.Command("aws", "ecs", "update-container-instances-state", "--cluster", cluster, "--container-instances", instanceArn, "--status", "DRAINING").Run()
 	if err != nil {
 		m.logSystemf("Unable to set EC2 instance state to DRAINING for %s", instanceArn)
 	}
+
+	return err
 }
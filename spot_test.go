@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetECSMetadata(t *testing.T) {
+	defer func(url string) { ECS_METADATA_URL = url }(ECS_METADATA_URL)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Cluster":"convox-Cluster-1E4XJ0PQWNAYS","ContainerInstanceArn":"arn:aws:ecs:us-east-1:012345678901:container-instance/d3d6b9ff"}`))
+	}))
+
+	ECS_METADATA_URL = ts.URL
+
+	m := &Monitor{}
+
+	cluster, err := m.getECSMetadata("Cluster")
+	assert.Nil(t, err)
+	assert.Equal(t, "convox-Cluster-1E4XJ0PQWNAYS", cluster)
+
+	_, err = m.getECSMetadata("Version")
+	assert.EqualError(t, err, "ecs metadata: no Version")
+
+	// the ECS agent being down is an error, not a panic
+	ts.Close()
+
+	_, err = m.getECSMetadata("Cluster")
+	assert.NotNil(t, err)
+}
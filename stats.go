@@ -0,0 +1,190 @@
+package main
+
+import (
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+var STATS_INTERVAL = 1 * time.Minute
+
+// Stats periodically reports the CPU, memory, network and block IO usage of every running container
+// as gauges with app and process dimensions, summed over the containers of each process
+func (m *Monitor) Stats() {
+	m.logSystemf("stats at=start")
+
+	reported := map[statsProcess]bool{}
+
+	for _ = range time.Tick(STATS_INTERVAL) {
+		containers, err := m.client.ListContainers(docker.ListContainersOptions{})
+		if err != nil {
+			m.logSystemf("stats ListContainers count#DockerListContainersError=1 err=%q", err)
+			m.metrics.Count("DockerListContainersError", m.dimensions(), 1)
+			continue
+		}
+
+		processes := map[statsProcess][]map[string]float64{}
+
+		for _, c := range containers {
+			if c.ID == m.agentId {
+				continue
+			}
+
+			env, ok := m.getEnv(c.ID)
+			if !ok {
+				continue
+			}
+
+			s, err := m.containerStats(c.ID)
+			if err != nil {
+				m.logSystemf("stats containerStats id=%s count#DockerStatsError=1 err=%q", c.ID, err)
+				m.metrics.Count("DockerStatsError", m.dimensions(), 1)
+				continue
+			}
+
+			p := statsProcess{App: appName(env), Process: env["PROCESS"]}
+			processes[p] = append(processes[p], statsMetrics(s))
+		}
+
+		reported = m.recordStats(processes, reported)
+	}
+}
+
+// recordStats sets the gauges of every process and removes the gauges of processes
+// that were reported last time but have no running containers now
+func (m *Monitor) recordStats(processes map[statsProcess][]map[string]float64, reported map[statsProcess]bool) map[statsProcess]bool {
+	current := map[statsProcess]bool{}
+
+	for p, samples := range processes {
+		dims := m.dimensions("app", p.App, "process", p.Process)
+
+		for name, v := range sumStatsMetrics(samples) {
+			m.metrics.Gauge(name, dims, v)
+		}
+
+		current[p] = true
+	}
+
+	for p := range reported {
+		if current[p] {
+			continue
+		}
+
+		dims := m.dimensions("app", p.App, "process", p.Process)
+
+		for _, name := range statsMetricNames {
+			m.metrics.Remove(name, dims)
+		}
+	}
+
+	return current
+}
+
+// statsProcess identifies the containers that share a set of gauges
+type statsProcess struct {
+	App     string
+	Process string
+}
+
+// containerStats returns a single Docker stats sample for a container
+func (m *Monitor) containerStats(id string) (*docker.Stats, error) {
+	ch := make(chan *docker.Stats, 1)
+	errch := make(chan error, 1)
+
+	go func() {
+		errch <- m.client.Stats(docker.StatsOptions{
+			ID:      id,
+			Stats:   ch,
+			Stream:  false,
+			Timeout: 30 * time.Second,
+		})
+	}()
+
+	s, ok := <-ch
+	err := <-errch
+
+	if !ok {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+var statsMetricNames = []string{
+	"ContainerMemoryUsage",
+	"ContainerMemoryLimit",
+	"ContainerMemoryRSS",
+	"ContainerMemoryUtilization",
+	"ContainerCPUUtilization",
+	"ContainerNetworkRxBytes",
+	"ContainerNetworkTxBytes",
+	"ContainerBlockReadBytes",
+	"ContainerBlockWriteBytes",
+}
+
+// statsMetrics converts a Docker stats sample to metrics
+// CPU is a percentage of one core, memory is in bytes, and network and block IO are byte totals
+// since the container started
+func statsMetrics(s *docker.Stats) map[string]float64 {
+	metrics := map[string]float64{
+		"ContainerMemoryUsage": float64(s.MemoryStats.Usage),
+		"ContainerMemoryLimit": float64(s.MemoryStats.Limit),
+		"ContainerMemoryRSS":   float64(s.MemoryStats.Stats.TotalRss),
+	}
+
+	if s.MemoryStats.Limit > 0 {
+		metrics["ContainerMemoryUtilization"] = float64(s.MemoryStats.Usage) / float64(s.MemoryStats.Limit) * 100
+	}
+
+	cpu := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	system := float64(s.CPUStats.SystemCPUUsage) - float64(s.PreCPUStats.SystemCPUUsage)
+
+	// the first sample of a container has no previous usage to compare against
+	if s.PreCPUStats.SystemCPUUsage > 0 && system > 0 && cpu >= 0 {
+		metrics["ContainerCPUUtilization"] = cpu / system * float64(len(s.CPUStats.CPUUsage.PercpuUsage)) * 100
+	}
+
+	var rx, tx uint64
+
+	for _, n := range s.Networks {
+		rx += n.RxBytes
+		tx += n.TxBytes
+	}
+
+	metrics["ContainerNetworkRxBytes"] = float64(rx)
+	metrics["ContainerNetworkTxBytes"] = float64(tx)
+
+	var read, write uint64
+
+	for _, e := range s.BlkioStats.IOServiceBytesRecursive {
+		switch e.Op {
+		case "Read":
+			read += e.Value
+		case "Write":
+			write += e.Value
+		}
+	}
+
+	metrics["ContainerBlockReadBytes"] = float64(read)
+	metrics["ContainerBlockWriteBytes"] = float64(write)
+
+	return metrics
+}
+
+// sumStatsMetrics adds up the metrics of the containers of one process
+// Memory utilization is recalculated from the summed usage and limit.
+func sumStatsMetrics(samples []map[string]float64) map[string]float64 {
+	sum := map[string]float64{}
+
+	for _, metrics := range samples {
+		for name, v := range metrics {
+			sum[name] += v
+		}
+	}
+
+	if _, ok := sum["ContainerMemoryUtilization"]; ok && sum["ContainerMemoryLimit"] > 0 {
+		sum["ContainerMemoryUtilization"] = sum["ContainerMemoryUsage"] / sum["ContainerMemoryLimit"] * 100
+	}
+
+	return sum
+}
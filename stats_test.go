@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsMetrics(t *testing.T) {
+	s := &docker.Stats{
+		Networks: map[string]docker.NetworkStats{
+			"eth0": {RxBytes: 1000, TxBytes: 200},
+			"eth1": {RxBytes: 24, TxBytes: 56},
+		},
+	}
+
+	s.MemoryStats.Usage = 256 * 1024 * 1024
+	s.MemoryStats.Limit = 512 * 1024 * 1024
+	s.MemoryStats.Stats.TotalRss = 128 * 1024 * 1024
+
+	s.CPUStats.CPUUsage.TotalUsage = 1500
+	s.CPUStats.CPUUsage.PercpuUsage = []uint64{750, 750}
+	s.CPUStats.SystemCPUUsage = 12000
+	s.PreCPUStats.CPUUsage.TotalUsage = 1000
+	s.PreCPUStats.SystemCPUUsage = 10000
+
+	s.BlkioStats.IOServiceBytesRecursive = []docker.BlkioStatsEntry{
+		{Op: "Read", Value: 4096},
+		{Op: "Write", Value: 8192},
+		{Op: "Total", Value: 12288},
+	}
+
+	assert.Equal(t, map[string]float64{
+		"ContainerCPUUtilization":    50,
+		"ContainerMemoryUsage":       256 * 1024 * 1024,
+		"ContainerMemoryLimit":       512 * 1024 * 1024,
+		"ContainerMemoryRSS":         128 * 1024 * 1024,
+		"ContainerMemoryUtilization": 50,
+		"ContainerNetworkRxBytes":    1024,
+		"ContainerNetworkTxBytes":    256,
+		"ContainerBlockReadBytes":    4096,
+		"ContainerBlockWriteBytes":   8192,
+	}, statsMetrics(s))
+
+	// no previous sample to compute CPU from
+	s.PreCPUStats.SystemCPUUsage = 0
+
+	_, ok := statsMetrics(s)["ContainerCPUUtilization"]
+	assert.False(t, ok)
+}
+
+func TestSumStatsMetrics(t *testing.T) {
+	sum := sumStatsMetrics([]map[string]float64{
+		{"ContainerMemoryUsage": 100, "ContainerMemoryLimit": 400, "ContainerMemoryUtilization": 25, "ContainerCPUUtilization": 30},
+		{"ContainerMemoryUsage": 300, "ContainerMemoryLimit": 400, "ContainerMemoryUtilization": 75},
+	})
+
+	assert.Equal(t, map[string]float64{
+		"ContainerMemoryUsage":       400,
+		"ContainerMemoryLimit":       800,
+		"ContainerMemoryUtilization": 50,
+		"ContainerCPUUtilization":    30,
+	}, sum)
+}
+
+func TestRecordStats(t *testing.T) {
+	m := &Monitor{instanceId: "i-553ffcd2", metrics: NewMetrics()}
+
+	web := statsProcess{App: "myapp", Process: "web"}
+	worker := statsProcess{App: "myapp", Process: "worker"}
+
+	reported := m.recordStats(map[statsProcess][]map[string]float64{
+		web:    {{"ContainerMemoryUsage": 100}},
+		worker: {{"ContainerMemoryUsage": 200}},
+	}, map[statsProcess]bool{})
+
+	assert.Equal(t, 2, len(m.metrics.Snapshot()))
+
+	// the worker process scaled to zero
+	m.recordStats(map[statsProcess][]map[string]float64{
+		web: {{"ContainerMemoryUsage": 150}},
+	}, reported)
+
+	series := m.metrics.Snapshot()
+
+	if assert.Equal(t, 1, len(series)) {
+		assert.Equal(t, "web", series[0].Dimensions["process"])
+		assert.Equal(t, 150.0, series[0].Value)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names sent to StatsD get this prefix
+var STATSD_PREFIX = "convox."
+
+// Buffered metrics are sent every STATSD_FLUSH_INTERVAL or when a datagram would exceed STATSD_MAX_PACKET bytes
+var (
+	STATSD_FLUSH_INTERVAL = 100 * time.Millisecond
+	STATSD_MAX_PACKET     = 1432
+)
+
+// StatsD sends metrics to a StatsD daemon over UDP
+// It is enabled with the STATSD_ADDR env, i.e. STATSD_ADDR=127.0.0.1:8125
+//
+// By default it speaks DogStatsD and tags every metric with its dimensions plus the
+// instance az and instanceType. STATSD_DOGSTATSD=false sends plain StatsD without tags.
+//
+// Metrics are buffered and sent newline separated so busy log lines do not cost a datagram each.
+type StatsD struct {
+	conn      net.Conn
+	dogstatsd bool
+	tags      Dimensions
+
+	lock sync.Mutex
+	buf  []byte
+}
+
+func NewStatsD(addr string, dogstatsd bool, tags Dimensions) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StatsD{conn: conn, dogstatsd: dogstatsd, tags: tags}
+
+	go s.flushEvery(STATSD_FLUSH_INTERVAL)
+
+	return s, nil
+}
+
+// Emit buffers a metric, sending the buffer first if the metric would not fit in the datagram
+func (s *StatsD) Emit(kind, name string, dims Dimensions, v float64) {
+	p := s.packet(kind, name, dims, v)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.buf) > 0 && len(s.buf)+1+len(p) > STATSD_MAX_PACKET {
+		s.send()
+	}
+
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+
+	s.buf = append(s.buf, p...)
+}
+
+// Flush sends the buffered metrics
+func (s *StatsD) Flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.send()
+}
+
+func (s *StatsD) flushEvery(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		s.Flush()
+	}
+}
+
+// send writes the buffer as one datagram
+// UDP is fire and forget so write errors are ignored
+// Callers must hold s.lock
+func (s *StatsD) send() {
+	if len(s.buf) == 0 {
+		return
+	}
+
+	s.conn.Write(s.buf)
+	s.buf = s.buf[:0]
+}
+
+func (s *StatsD) packet(kind, name string, dims Dimensions, v float64) string {
+	var typ string
+
+	switch kind {
+	case "counter":
+		typ = "c"
+	case "gauge":
+		typ = "g"
+	case "histogram":
+		// plain statsd timers are milliseconds, so unitless observations are sent as gauges
+		typ = "g"
+		if s.dogstatsd {
+			typ = "h"
+		}
+	}
+
+	p := fmt.Sprintf("%s%s:%g|%s", STATSD_PREFIX, name, v, typ)
+
+	if !s.dogstatsd {
+		return p
+	}
+
+	all := Dimensions{}
+
+	for k, v := range s.tags {
+		all[k] = v
+	}
+
+	for k, v := range dims {
+		all[k] = v
+	}
+
+	tags := []string{}
+
+	for _, k := range sortedKeys(all) {
+		if all[k] != "" {
+			tags = append(tags, k+":"+statsdTagEscaper.Replace(all[k]))
+		}
+	}
+
+	if len(tags) > 0 {
+		p += "|#" + strings.Join(tags, ",")
+	}
+
+	return p
+}
+
+// commas separate tags and pipes separate packet sections
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
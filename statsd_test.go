@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsD(t *testing.T) {
+	defer func(interval time.Duration) { STATSD_FLUSH_INTERVAL = interval }(STATSD_FLUSH_INTERVAL)
+
+	STATSD_FLUSH_INTERVAL = 1 * time.Hour
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	s, err := NewStatsD(l.LocalAddr().String(), true, Dimensions{"az": "us-east-1c", "instanceType": "r3.large"})
+	assert.Nil(t, err)
+
+	ms := NewMetrics()
+	ms.AddEmitter(s)
+
+	dims := Dimensions{"instanceId": "i-553ffcd2", "app": "myapp", "process": "web"}
+
+	ms.Count("LinesForwarded", dims, 1)
+	ms.Gauge("disk.utilization", Dimensions{"instanceId": "i-553ffcd2", "volume": "root"}, 16.02)
+	ms.Observe("DockerPsLatency", Dimensions{"instanceId": "i-553ffcd2"}, 0.25)
+
+	buf := make([]byte, 2048)
+
+	// metrics recorded between flushes arrive in one datagram
+	s.Flush()
+
+	l.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	n, _, err := l.ReadFrom(buf)
+	assert.Nil(t, err)
+
+	assert.Equal(t, strings.Join([]string{
+		"convox.LinesForwarded:1|c|#app:myapp,az:us-east-1c,instanceId:i-553ffcd2,instanceType:r3.large,process:web",
+		"convox.disk.utilization:16.02|g|#az:us-east-1c,instanceId:i-553ffcd2,instanceType:r3.large,volume:root",
+		"convox.DockerPsLatency:0.25|h|#az:us-east-1c,instanceId:i-553ffcd2,instanceType:r3.large",
+	}, "\n"), string(buf[0:n]))
+
+	// a full buffer is sent before it would exceed the max packet size
+	for i := 0; i < 20; i++ {
+		ms.Count("LinesForwarded", dims, 1)
+	}
+
+	s.Flush()
+
+	lines := 0
+
+	for lines < 20 {
+		l.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+		n, _, err = l.ReadFrom(buf)
+		if !assert.Nil(t, err) {
+			break
+		}
+
+		assert.True(t, n <= STATSD_MAX_PACKET)
+		lines += len(strings.Split(string(buf[0:n]), "\n"))
+	}
+
+	assert.Equal(t, 20, lines)
+}
+
+func TestStatsDPlain(t *testing.T) {
+	s := &StatsD{tags: Dimensions{"az": "us-east-1c"}}
+
+	assert.Equal(t, "convox.DockerPsLatency:0.25|g", s.packet("histogram", "DockerPsLatency", Dimensions{"instanceId": "i-553ffcd2"}, 0.25))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// agentStatus is what the status API reports about a running agent
+type agentStatus struct {
+	Agent      statusAgent              `json:"agent"`
+	Instance   statusInstance           `json:"instance"`
+	Started    time.Time                `json:"started"`
+	Uptime     float64                  `json:"uptime_seconds"`
+	Health     statusHealth             `json:"health"`
+	Containers []statusContainer        `json:"containers"`
+	Kinesis    map[string]statusBacklog `json:"kinesis"`
+}
+
+type statusAgent struct {
+	Id      string `json:"id"`
+	Image   string `json:"image"`
+	Version string `json:"version"`
+}
+
+type statusInstance struct {
+	AmiId               string `json:"ami_id"`
+	Az                  string `json:"az"`
+	InstanceId          string `json:"instance_id"`
+	InstanceType        string `json:"instance_type"`
+	Region              string `json:"region"`
+	DockerDriver        string `json:"docker_driver"`
+	DockerServerVersion string `json:"docker_server_version"`
+	EcsAgentImage       string `json:"ecs_agent_image"`
+	KernelVersion       string `json:"kernel_version"`
+}
+
+type statusHealth struct {
+	Status HealthStatus   `json:"status"`
+	Checks []HealthResult `json:"checks"`
+}
+
+// statusContainer only includes the env the agent uses to route logs, never app secrets
+type statusContainer struct {
+	Id      string `json:"id"`
+	App     string `json:"app"`
+	Process string `json:"process"`
+	Release string `json:"release"`
+	Logger  bool   `json:"logger"`
+}
+
+type statusBacklog struct {
+	Records int `json:"records"`
+	Bytes   int `json:"bytes"`
+	Dropped int `json:"dropped"`
+}
+
+// ServeStatus serves the agent status as JSON at / on STATUS_ADDR
+// It listens on 127.0.0.1:9103 by default, or a unix socket with STATUS_ADDR=unix:/var/run/convox-agent.sock
+func (m *Monitor) ServeStatus() {
+	addr := os.Getenv("STATUS_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:9103"
+	}
+
+	m.logSystemf("status at=start addr=%s", addr)
+
+	network := "tcp"
+
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		os.Remove(addr)
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		m.logSystemf("status Listen addr=%s count#StatusListenError=1 err=%q", addr, err)
+		return
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(m.status(time.Now()), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+
+	if err := http.Serve(l, mux); err != nil {
+		m.logSystemf("status Serve addr=%s count#StatusServeError=1 err=%q", addr, err)
+	}
+}
+
+func (m *Monitor) status(now time.Time) *agentStatus {
+	health, checks := m.health.Status()
+
+	s := &agentStatus{
+		Agent: statusAgent{
+			Id:      m.agentId,
+			Image:   m.agentImage,
+			Version: m.agentVersion,
+		},
+		Instance: statusInstance{
+			AmiId:               m.amiId,
+			Az:                  m.az,
+			InstanceId:          m.instanceId,
+			InstanceType:        m.instanceType,
+			Region:              m.region,
+			DockerDriver:        m.dockerDriver,
+			DockerServerVersion: m.dockerServerVersion,
+			EcsAgentImage:       m.ecsAgentImage,
+			KernelVersion:       m.kernelVersion,
+		},
+		Started:    m.started,
+		Uptime:     now.Sub(m.started).Seconds(),
+		Health:     statusHealth{Status: health, Checks: checks},
+		Containers: []statusContainer{},
+		Kinesis:    map[string]statusBacklog{},
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for id, env := range m.envs {
+		_, logger := m.loggers[id]
+
+		s.Containers = append(s.Containers, statusContainer{
+			Id:      id,
+			App:     appName(env),
+			Process: env["PROCESS"],
+			Release: env["RELEASE"],
+			Logger:  logger,
+		})
+	}
+
+	sort.Sort(statusContainersById(s.Containers))
+
+	for stream, lines := range m.lines {
+		s.Kinesis[stream] = statusBacklog{
+			Records: len(lines),
+			Bytes:   m.bufferBytes[stream],
+			Dropped: m.droppedTotal[stream],
+		}
+	}
+
+	return s
+}
+
+type statusContainersById []statusContainer
+
+func (a statusContainersById) Len() int           { return len(a) }
+func (a statusContainersById) Less(i, j int) bool { return a[i].Id < a[j].Id }
+func (a statusContainersById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
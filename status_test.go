@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	started := time.Date(2016, 4, 20, 17, 59, 27, 0, time.UTC)
+
+	m := &Monitor{
+		started:      started,
+		agentVersion: "0.73",
+		instanceId:   "i-553ffcd2",
+		health:       NewHealth(),
+		envs: map[string]map[string]string{
+			"2f3c6e1a9b00": {"APP": "myapp", "PROCESS": "worker", "RELEASE": "RXZMCQEPDKO", "SECRET_KEY": "shh"},
+			"1d11a78279e0": {"LOG_GROUP": "myapp-LogGroup-1KIJO8SS9F3Q9", "PROCESS": "web", "RELEASE": "RXZMCQEPDKO"},
+		},
+		loggers: map[string]logger.Logger{
+			"1d11a78279e0": nil,
+		},
+		lines: map[string][]*kinesisRecord{
+			"convox-Kinesis": {{Data: []byte("hello")}, {Data: []byte("world")}},
+		},
+		bufferBytes:  map[string]int{"convox-Kinesis": 10},
+		droppedTotal: map[string]int{"convox-Kinesis": 3},
+	}
+
+	m.health.Register(NewHealthCheck("docker", time.Minute, nil), 1)
+	m.health.Record("docker", HealthFailed, "signal: killed", started)
+
+	s := m.status(started.Add(90 * time.Second))
+
+	assert.Equal(t, "0.73", s.Agent.Version)
+	assert.Equal(t, "i-553ffcd2", s.Instance.InstanceId)
+	assert.Equal(t, 90.0, s.Uptime)
+
+	assert.Equal(t, HealthFailed, s.Health.Status)
+	assert.Equal(t, "signal: killed", s.Health.Checks[0].Detail)
+
+	assert.Equal(t, []statusContainer{
+		{Id: "1d11a78279e0", App: "myapp", Process: "web", Release: "RXZMCQEPDKO", Logger: true},
+		{Id: "2f3c6e1a9b00", App: "myapp", Process: "worker", Release: "RXZMCQEPDKO", Logger: false},
+	}, s.Containers)
+
+	assert.Equal(t, map[string]statusBacklog{
+		"convox-Kinesis": {Records: 2, Bytes: 10, Dropped: 3},
+	}, s.Kinesis)
+}